@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// minPasswordLength is the shortest password an account can have.
+	minPasswordLength = 8
+
+	// passwordIterations is how many rounds of PBKDF2 a password is put
+	// through, which makes guessing it slow.
+	passwordIterations = 600000
+	passwordSaltLength = 16
+	passwordHashLength = 32
+
+	// maxLoginAttempts is how many wrong passwords someone can enter before
+	// they're disconnected.
+	maxLoginAttempts = 3
+)
+
+var (
+	errAccountExists    = errors.New("that name is already registered")
+	errNameReserved     = errors.New("that name belongs to an admin or moderator, whose account has to be added by whoever runs the server")
+	errWrongPassword    = errors.New("wrong name or password")
+	errTooManyLogins    = errors.New("too many login attempts, try again later")
+	errPasswordTooShort = errors.New("passwords need to be at least " + strconv.Itoa(minPasswordLength) + " characters long")
+)
+
+// An account is a registered user name, and the hash of its password.
+// Iterations is kept with each one so it can be raised later without
+// breaking existing passwords.
+type account struct {
+	Name       string
+	Salt       []byte
+	Hash       []byte
+	Iterations int
+	Created    time.Time
+}
+
+// An accountStore holds every registered account, saving them to disk
+// whenever one is added. Users log in as they connect, before they're part
+// of the hub, so it's safe to use from multiple goroutines.
+type accountStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]*account
+
+	// reserved are the names that can't be registered by whoever picks
+	// them first, because the config gives them a role.
+	reserved map[string]bool
+}
+
+func newAccountStore(path string, reserved []string) (*accountStore, error) {
+	s := &accountStore{
+		path:     path,
+		accounts: make(map[string]*account),
+		reserved: make(map[string]bool),
+	}
+	for _, name := range reserved {
+		s.reserved[name] = true
+	}
+	var accounts []*account
+	if err := loadJSON(path, &accounts); err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		s.accounts[a.Name] = a
+	}
+	return s, nil
+}
+
+// exists reports whether name is registered.
+func (s *accountStore) exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.accounts[name]
+	return ok
+}
+
+// register creates an account for name with the given password, unless the
+// name is reserved.
+func (s *accountStore) register(name, password string) error {
+	if s.reserved[name] {
+		return errNameReserved
+	}
+	return s.add(name, password)
+}
+
+// add creates an account for name with the given password, even if the name
+// is reserved.
+func (s *accountStore) add(name, password string) error {
+	if len(password) < minPasswordLength {
+		return errPasswordTooShort
+	}
+	if s.exists(name) {
+		return errAccountExists
+	}
+	a := &account{
+		Name:       name,
+		Salt:       make([]byte, passwordSaltLength),
+		Iterations: passwordIterations,
+		Created:    time.Now(),
+	}
+	if _, err := rand.Read(a.Salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, a.Salt, a.Iterations)
+	if err != nil {
+		return err
+	}
+	a.Hash = hash
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Someone else could have taken the name while the password was being
+	// hashed.
+	if _, ok := s.accounts[name]; ok {
+		return errAccountExists
+	}
+	s.accounts[name] = a
+	return s.save()
+}
+
+// authenticate checks the password for the named account. It takes as long
+// for names that aren't registered as for ones that are, so it can't be
+// used to find out which names exist.
+func (s *accountStore) authenticate(name, password string) error {
+	s.mu.Lock()
+	a, ok := s.accounts[name]
+	s.mu.Unlock()
+	if !ok {
+		hashPassword(password, make([]byte, passwordSaltLength), passwordIterations)
+		return errWrongPassword
+	}
+	hash, err := hashPassword(password, a.Salt, a.Iterations)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(hash, a.Hash) != 1 {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// save writes every account to disk. The caller must hold the lock.
+func (s *accountStore) save() error {
+	accounts := make([]*account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Created.Before(accounts[j].Created) })
+	return saveJSON(s.path, accounts)
+}
+
+// AddAccount creates an account for name with the given password, in the data
+// directory set by the config. It's how admins and moderators are given
+// their accounts, since nobody can register the names the config gives a role
+// to. It shouldn't be used while the server is running, which wouldn't see
+// the new account.
+func AddAccount(cfg *Config, name, password string) error {
+	s, err := newAccountStore(dataPath(cfg, "accounts.json"), nil)
+	if err != nil {
+		return err
+	}
+	return s.add(name, password)
+}
+
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, passwordHashLength)
+}
+
+// inlinePassword reports whether m is a /register command with a password
+// typed after it. It would be seen by middleware on its way to the command,
+// so it's turned away first.
+func inlinePassword(m *Message) bool {
+	name, arg := splitArg(m.Text)
+	return m.MessageType == command && name == "/register" && arg != ""
+}
+
+// register creates an account for a user who connected without one, and
+// logs them in to it. The text of the message is the password.
+func (h *hub) register(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if user.account != "" {
+		user.conn.write(newMessage("you", "server", "You're already logged in as "+user.account+".\n", text))
+		return
+	}
+	if user.credential != nil {
+		user.conn.write(newMessage("you", "server", "Accounts can't be registered through the API.\n", text))
+		return
+	}
+	// Hashing the password takes a while, so it's done without holding up
+	// the run loop.
+	name := user.name
+	go func() {
+		err := h.accounts.register(name, m.Text)
+		h.do(func() {
+			if h.users[name] != user {
+				return
+			}
+			if err != nil {
+				user.conn.write(newMessage("you", "server", "Couldn't register "+name+": "+err.Error()+".\n", text))
+				return
+			}
+			user.account = name
+			user.role = h.roleFor(user.account)
+			h.logger.Printf("(%s registered)", name)
+			user.conn.write(newMessage("you", "server", "Registered "+name+". You'll need your password to use this name from now on.\n", text))
+		})
+	}()
+}
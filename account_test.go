@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReservedNamesCantBeRegistered(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "accounts.json")
+	s, err := newAccountStore(path, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.register("alice", "longpassword"); err != errNameReserved {
+		t.Fatalf("registering a reserved name: got %v, want %v", err, errNameReserved)
+	}
+	if err := s.register("bob", "short"); err != errPasswordTooShort {
+		t.Fatalf("registering with a short password: got %v, want %v", err, errPasswordTooShort)
+	}
+	if err := s.register("bob", "longpassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever runs the server can still add an account for the name.
+	if err := AddAccount(&Config{DataDir: dir}, "alice", "longpassword"); err != nil {
+		t.Fatal(err)
+	}
+	s, err = newAccountStore(path, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.authenticate("alice", "longpassword"); err != nil {
+		t.Fatalf("alice couldn't log in: %v", err)
+	}
+	if err := s.authenticate("alice", "wrongpassword"); err != errWrongPassword {
+		t.Fatalf("logging in with the wrong password: got %v, want %v", err, errWrongPassword)
+	}
+	if err := s.register("alice", "longpassword"); err != errNameReserved {
+		t.Fatalf("registering an added reserved name: got %v, want %v", err, errNameReserved)
+	}
+}
+
+func TestInlinePasswordsDontReachMiddleware(t *testing.T) {
+	var seen []string
+	spy := func(next Handler) Handler {
+		return HandlerFunc(func(r Replier, m *Message) {
+			seen = append(seen, m.Text)
+			next.ServeMessage(r, m)
+		})
+	}
+	h := startHub(t, nil, t.TempDir(), spy)
+	bob := connect(h, "bob", "")
+	run(h, "bob", defaultChannelName, "/register hunter2hunter2")
+	h.do(func() {
+		for _, s := range seen {
+			if strings.Contains(s, "hunter2") {
+				t.Errorf("middleware saw the password in %q", s)
+			}
+		}
+	})
+	if !bob.saw("Passwords can't be typed") {
+		t.Error("bob wasn't told why")
+	}
+	if h.accounts.exists("bob") {
+		t.Error("bob was registered")
+	}
+}
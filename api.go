@@ -2,7 +2,12 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -12,8 +17,19 @@ func getServeMux(h *hub) http.Handler {
 	r := httprouter.New()
 
 	r.GET("/", homeHandler)
-	r.POST("/messages", handle(h, newMessageHandler))
+	r.POST("/messages", handle(h, authorized(scopePost, false, newMessageHandler)))
 	r.POST("/ws", handle(h, createWSUserHandler))
+	r.GET("/channels", handle(h, channelsHandler))
+	r.GET("/channels/:name/messages", handle(h, authorized(scopeRead, true, channelMessagesHandler)))
+	r.GET("/channels/:name/threads/:id", handle(h, authorized(scopeRead, true, threadHandler)))
+	r.GET("/presence", handle(h, presenceHandler))
+	r.GET("/presence/:name", handle(h, presenceHandler))
+	r.GET("/unread", handle(h, authorized(scopeRead, false, unreadHandler)))
+	r.GET("/commands", handle(h, commandsHandler))
+	r.POST("/commands", handle(h, authorized(scopeManage, false, newCommandHandler)))
+	r.GET("/admin/tokens", handle(h, adminOnly(tokensHandler)))
+	r.POST("/admin/tokens", handle(h, adminOnly(newTokenHandler)))
+	r.DELETE("/admin/tokens/:id", handle(h, adminOnly(revokeTokenHandler)))
 
 	return r
 }
@@ -33,12 +49,23 @@ func homeHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 }
 
 func createWSUserHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if b := h.bans.addrBanned(r.RemoteAddr); b != nil {
+		http.Error(w, "You're banned from this server.", http.StatusForbidden)
+		return
+	}
 	u := createWSUser(h, w, r, nil)
+	if u == nil {
+		return
+	}
 	h.userCh <- u
 }
 
 func newMessageHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	msg := &message{}
+	if b := h.bans.addrBanned(r.RemoteAddr); b != nil {
+		http.Error(w, "You're banned from this server.", http.StatusForbidden)
+		return
+	}
+	msg := &Message{}
 	err := json.NewDecoder(r.Body).Decode(&msg)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -46,6 +73,303 @@ func newMessageHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprou
 	}
 	defer r.Body.Close()
 
-	h.messageCh <- msg
+	if !stampSender(w, r, msg) {
+		return
+	}
+	msg.addr = hostOf(r.RemoteAddr)
+	c := credentialFrom(r)
+	var dest string
+	h.do(func() {
+		// Replies and changes to other messages end up in the channel of
+		// the message they're for, whatever channel they say.
+		if dest = h.destination(msg); c.allowsChannel(dest) {
+			h.apiReceive(msg, c)
+		}
+	})
+	if !c.allowsChannel(dest) {
+		http.Error(w, "You aren't allowed to use that token in "+dest+".", http.StatusForbidden)
+		return
+	}
 	w.Write([]byte("Sent message " + msg.Text + " as user " + msg.Username + " to channel " + msg.Channel + "\n"))
 }
+
+// stampSender marks msg as being from whoever the request's credential
+// belongs to, as long as it's allowed to send that kind of message to that
+// channel. A message that says it's from somebody else is refused.
+func stampSender(w http.ResponseWriter, r *http.Request, msg *Message) bool {
+	c := credentialFrom(r)
+	if msg.Username != "" && msg.Username != c.name {
+		http.Error(w, "You can only send messages as yourself.", http.StatusForbidden)
+		return false
+	}
+	if s := scopeFor(msg.MessageType); !c.allows(s) {
+		http.Error(w, "You aren't allowed to "+string(s)+" with that token.", http.StatusForbidden)
+		return false
+	}
+	if !c.allowsChannel(msg.Channel) {
+		http.Error(w, "You aren't allowed to use that token in "+msg.Channel+".", http.StatusForbidden)
+		return false
+	}
+	msg.Username = c.name
+	msg.from = c.name
+	return true
+}
+
+// destination returns the channel m ends up in, which is the channel of the
+// message it replies to or changes, if there is one.
+func (h *hub) destination(m *Message) string {
+	id := m.ReplyTo
+	switch m.MessageType {
+	case edit, remove, react, unreact:
+		id = m.Target
+	}
+	if id > 0 {
+		if other, err := h.store.Message(id); err == nil {
+			return other.Channel
+		}
+	}
+	return m.Channel
+}
+
+func commandsHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commandInfos())
+}
+
+// newCommandHandler runs a command, just like one typed by whoever the
+// request's credential belongs to, and returns everything the command sent
+// back to them.
+func newCommandHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if b := h.bans.addrBanned(r.RemoteAddr); b != nil {
+		http.Error(w, "You're banned from this server.", http.StatusForbidden)
+		return
+	}
+	msg := &Message{}
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	msg.Text = strings.TrimSpace(msg.Text)
+	if !strings.HasPrefix(msg.Text, "/") {
+		http.Error(w, "Text must be a command, starting with /", http.StatusBadRequest)
+		return
+	}
+	if msg.Channel == "" {
+		msg.Channel = defaultChannelName
+	}
+	msg.MessageType = command
+	if !stampSender(w, r, msg) {
+		return
+	}
+	msg.addr = hostOf(r.RemoteAddr)
+	var replies []*Message
+	h.do(func() {
+		replies = h.apiReceive(msg, credentialFrom(r))
+	})
+	if replies == nil {
+		replies = []*Message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replies)
+}
+
+// A replyRecorder keeps everything written to an API session, so it can be
+// returned in the response.
+type replyRecorder struct {
+	replies []*Message
+}
+
+func (rr *replyRecorder) read() error { return nil }
+
+func (rr *replyRecorder) write(m *Message) error {
+	rr.replies = append(rr.replies, m)
+	return nil
+}
+
+func (rr *replyRecorder) close() {}
+
+// newSession returns a user for an API request made with c. They have the
+// role of the account they logged in to, if any, and aren't in the hub, so
+// anybody connected with the same name is somebody else as far as they're
+// concerned.
+func (h *hub) newSession(c *credential, addr string) *User {
+	now := time.Now()
+	user := &User{
+		name:       c.name,
+		role:       h.roleFor(""),
+		addr:       addr,
+		conn:       &replyRecorder{},
+		transport:  transportAPI,
+		connected:  now,
+		lastActive: now,
+		credential: c,
+	}
+	if c.account {
+		user.account = c.name
+		user.role = h.roleFor(c.name)
+	}
+	return user
+}
+
+// apiReceive handles a message sent through the API as a new session, and
+// returns everything written to it while the message was handled.
+func (h *hub) apiReceive(m *Message, c *credential) []*Message {
+	user := h.newSession(c, m.addr)
+	rr := user.conn.(*replyRecorder)
+	user.conn = &ignoringConn{connection: rr, h: h, u: user}
+	m.session = user
+	h.receive(m)
+	h.removeUser(user)
+	h.apiSeen[user.name] = user.lastActive
+	return rr.replies
+}
+
+func channelsHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.channelInfo())
+}
+
+// presenceHandler returns the presence of everyone who's around, or of the
+// named user.
+func presenceHandler(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var v interface{}
+	infos := h.presence()
+	if name := ps.ByName("name"); name == "" {
+		v = infos
+	} else {
+		for _, info := range infos {
+			if info.Name == name {
+				v = info
+			}
+		}
+		if v == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// unreadHandler returns how many messages the request's user hasn't read in
+// each of their channels, and how many of those mention them.
+func unreadHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	infos := h.unreadInfo(credentialFrom(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// A historyPage is a page of a channel's history, as returned by the API.
+// Next is the cursor to pass as before to get the page of messages before
+// this one, and is zero once there aren't any.
+type historyPage struct {
+	Channel  string
+	Messages []*Message
+	Next     uint64 `json:",omitempty"`
+}
+
+// channelMessagesHandler returns a page of a channel's history. Passing
+// before walks back through the history, while passing after returns the
+// messages sent after that sequence number, for catching up on anything
+// missed.
+func channelMessagesHandler(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	// Direct messages are kept in logs starting with @, and those aren't
+	// anybody else's business. Neither are private channels.
+	if strings.HasPrefix(name, "@") || !canRead(h, r, name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	before, err := queryUint(q, "before")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := queryUint(q, "after")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := historyLimit(q.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := &historyPage{Channel: name}
+	if after > 0 {
+		page.Messages, err = h.store.After(name, after, limit)
+	} else {
+		page.Messages, page.Next, err = h.store.Page(name, before, limit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page.Messages == nil {
+		page.Messages = []*Message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// A thread is a message and all of the replies to it, as returned by the API.
+type thread struct {
+	Channel string
+	Message *Message
+	Replies []*Message
+}
+
+func threadHandler(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := parseMessageID(ps.ByName("id"))
+	if !ok {
+		http.Error(w, "id must be the ID of a message", http.StatusBadRequest)
+		return
+	}
+	root, replies, err := h.store.Thread(id)
+	// Only messages in channels the request can read have threads the API
+	// can see, and only in the channel the URL says they're in.
+	if err != nil || root.MessageType != text || root.Channel != ps.ByName("name") || !canRead(h, r, root.Channel) {
+		http.NotFound(w, r)
+		return
+	}
+	if replies == nil {
+		replies = []*Message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&thread{
+		Channel: root.Channel,
+		Message: root,
+		Replies: replies,
+	})
+}
+
+// canRead reports whether the request can read the named channel's history.
+// Anyone can read public channels, but private ones can only be read with a
+// token that has the read scope and names the channel.
+func canRead(h *hub, r *http.Request, name string) bool {
+	if h.isPublic(name) {
+		return true
+	}
+	c := credentialFrom(r)
+	return c != nil && c.channels[name] && c.allows(scopeRead) && h.channelExists(name)
+}
+
+// queryUint returns the named query parameter as a number, or zero if it
+// isn't set.
+func queryUint(q url.Values, key string) (uint64, error) {
+	s := q.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New(key + " must be a sequence number")
+	}
+	return n, nil
+}
@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoginsAreLimited(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	for i := 0; i < loginLimit.Burst; i++ {
+		if !h.allowLogin("192.0.2.1") {
+			t.Fatalf("login %d was refused", i+1)
+		}
+	}
+	if h.allowLogin("192.0.2.1") {
+		t.Fatal("logins weren't limited")
+	}
+	if !h.allowLogin("192.0.2.2") {
+		t.Fatal("another address was limited too")
+	}
+
+	// Once an address is limited, its passwords aren't even checked.
+	r := httptest.NewRequest("GET", "/unread", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.SetBasicAuth("alice", "longpassword")
+	w := httptest.NewRecorder()
+	getServeMux(h).ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+// postCommand sends cmd through the API with the given token, and returns
+// the replies.
+func postCommand(t *testing.T, h *hub, token, cmd string) []*Message {
+	t.Helper()
+	body, _ := json.Marshal(&Message{Text: cmd})
+	r := httptest.NewRequest("POST", "/commands", strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	getServeMux(h).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var replies []*Message
+	if err := json.NewDecoder(w.Body).Decode(&replies); err != nil {
+		t.Fatal(err)
+	}
+	return replies
+}
+
+func said(replies []*Message, s string) bool {
+	for _, m := range replies {
+		if strings.Contains(m.Text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAPICommandsReturnReplies(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	_, token, err := h.tokens.issue("ci", []string{"manage"}, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies := postCommand(t, h, token, "/listrooms"); !said(replies, defaultChannelName) {
+		t.Errorf("got %+v", replies)
+	}
+	if replies := postCommand(t, h, token, "/nonsense"); !said(replies, "doesn't exist") {
+		t.Errorf("got %+v", replies)
+	}
+	h.do(func() {
+		if _, ok := h.users["ci"]; ok {
+			t.Error("ci was left in the hub")
+		}
+	})
+}
+
+func TestAPICallersDontBorrowConnectedUsers(t *testing.T) {
+	h := startHub(t, &Config{Admins: []string{"ci"}}, t.TempDir())
+	_, token, err := h.tokens.issue("ci", []string{"manage"}, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An admin who happens to be called ci doesn't lend the token their
+	// role, or get its replies.
+	c := connect(h, "ci", "ci")
+	if replies := postCommand(t, h, token, "/tokens"); !said(replies, "Only admins") {
+		t.Errorf("got %+v", replies)
+	}
+	if c.saw("Only admins") {
+		t.Error("the reply was sent to ci's connection")
+	}
+}
+
+// postMessage sends m through the API with the given token, and returns the
+// response's status.
+func postMessage(t *testing.T, h *hub, token string, m *Message) int {
+	t.Helper()
+	body, _ := json.Marshal(m)
+	r := httptest.NewRequest("POST", "/messages", strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	getServeMux(h).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestTokensCanChangeTheirOwnMessages(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	_, token, err := h.tokens.issue("ci", []string{"post"}, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := postMessage(t, h, token, &Message{Channel: defaultChannelName, Text: "Build #42 passed\n", MessageType: text}); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if code := postMessage(t, h, token, &Message{Channel: defaultChannelName, Target: 1, MessageType: remove}); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if m, err := h.store.Message(1); err != nil || !m.Deleted {
+		t.Errorf("got %+v, %v, want the message deleted", m, err)
+	}
+}
+
+func TestTokensStayInTheirChannels(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "")
+	run(h, "alice", defaultChannelName, "/newroom ops")
+	run(h, "alice", "ops", "/mode invite")
+	post(h, newMessage("ops", "alice", "deploying\n", text))
+	run(h, "alice", defaultChannelName, "/newroom builds")
+	_, token, err := h.tokens.issue("ci", []string{"post"}, []string{"builds"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replies and reactions end up in the channel of the message they're
+	// for, which this token can't be used in.
+	reply := &Message{Channel: "builds", Text: "me too\n", MessageType: text, ReplyTo: 1}
+	if code := postMessage(t, h, token, reply); code != http.StatusForbidden {
+		t.Errorf("got status %d for a reply, want %d", code, http.StatusForbidden)
+	}
+	reaction := &Message{Channel: "builds", Text: ":+1:", MessageType: react, Target: 1}
+	if code := postMessage(t, h, token, reaction); code != http.StatusForbidden {
+		t.Errorf("got status %d for a reaction, want %d", code, http.StatusForbidden)
+	}
+	if seq, _ := h.store.LastSeq("ops"); seq != 1 {
+		t.Error("the reply was sent to ops")
+	}
+	if m, _ := h.store.Message(1); len(m.Reactions) > 0 {
+		t.Error("the reaction was added in ops")
+	}
+}
+
+func TestSlowModeAppliesToTokens(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "")
+	run(h, "alice", defaultChannelName, "/newroom builds")
+	run(h, "alice", "builds", "/slowmode 60")
+	_, token, err := h.tokens.issue("ci", []string{"post"}, nil, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		postMessage(t, h, token, &Message{Channel: "builds", Text: "Build passed\n", MessageType: text})
+	}
+	if seq, _ := h.store.LastSeq("builds"); seq != 1 {
+		t.Errorf("got %d messages, want 1", seq)
+	}
+}
+
+func TestHandshakeProblemsAreTheClients(t *testing.T) {
+	h := startHub(t, &Config{Admins: []string{"admin"}}, t.TempDir())
+	if err := h.bans.add(&banEntry{Target: "troll", By: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"Name": "server"}`, http.StatusBadRequest},
+		{`{"Name": "bob", "Password": "short"}`, http.StatusBadRequest},
+		{`{"Name": "admin", "Password": "longpassword"}`, http.StatusForbidden},
+		{`{"Name": "troll"}`, http.StatusForbidden},
+		{`not json`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		getServeMux(h).ServeHTTP(w, httptest.NewRequest("POST", "/ws", strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("got status %d for %s, want %d", w.Code, c.body, c.want)
+		}
+	}
+}
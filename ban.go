@@ -0,0 +1,335 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A banEntry keeps a user name, IP address or range of addresses out of the
+// server until it expires.
+type banEntry struct {
+	Target  string
+	Reason  string
+	By      string
+	Created time.Time
+
+	// Expires is when the ban ends. Bans without one last forever.
+	Expires time.Time
+}
+
+func (b *banEntry) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// describe returns a short description of the ban, for telling users about
+// it.
+func (b *banEntry) describe() string {
+	s := b.Target + " is banned"
+	if !b.Expires.IsZero() {
+		s += " until " + b.Expires.Format("Jan 2 15:04 MST")
+	}
+	if b.Reason != "" {
+		s += " (" + b.Reason + ")"
+	}
+	return s
+}
+
+// A banList holds every ban, saving them to disk whenever they change. It's
+// checked as connections are accepted, as well as by the hub, so it's safe
+// to use from multiple goroutines.
+type banList struct {
+	mu   sync.Mutex
+	path string
+	bans map[string]*banEntry
+}
+
+func newBanList(path string) (*banList, error) {
+	l := &banList{
+		path: path,
+		bans: make(map[string]*banEntry),
+	}
+	var bans []*banEntry
+	if err := loadJSON(path, &bans); err != nil {
+		return nil, err
+	}
+	for _, b := range bans {
+		l.bans[b.Target] = b
+	}
+	return l, nil
+}
+
+// banTarget returns the form a ban's target is stored in. IP addresses and
+// ranges are normalised so that the same ban can't be added twice by
+// writing it differently.
+func banTarget(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet.String()
+	}
+	return s
+}
+
+// isAddrTarget reports whether a ban's target is an address or range, rather
+// than a user name.
+func isAddrTarget(target string) bool {
+	if net.ParseIP(target) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(target)
+	return err == nil
+}
+
+func (l *banList) add(b *banEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b.Target = banTarget(b.Target)
+	l.bans[b.Target] = b
+	return l.save()
+}
+
+// remove lifts the ban on target, reporting whether there was one.
+func (l *banList) remove(target string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	target = banTarget(target)
+	if _, ok := l.bans[target]; !ok {
+		return false, nil
+	}
+	delete(l.bans, target)
+	return true, l.save()
+}
+
+// save writes the bans that haven't expired to disk. The caller must hold
+// the lock.
+func (l *banList) save() error {
+	now := time.Now()
+	var bans []*banEntry
+	for target, b := range l.bans {
+		if b.expired(now) {
+			delete(l.bans, target)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return saveJSON(l.path, bans)
+}
+
+// nameBanned returns the ban on the user name, if there is one.
+func (l *banList) nameBanned(name string) *banEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[name]
+	if !ok || b.expired(time.Now()) || isAddrTarget(b.Target) {
+		return nil
+	}
+	return b
+}
+
+// addrBanned returns a ban covering the host, which can be an address on
+// its own or with a port, if there is one.
+func (l *banList) addrBanned(host string) *banEntry {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, b := range l.bans {
+		if b.expired(now) {
+			continue
+		}
+		if banned := net.ParseIP(b.Target); banned != nil && banned.Equal(ip) {
+			return b
+		}
+		if _, ipnet, err := net.ParseCIDR(b.Target); err == nil && ipnet.Contains(ip) {
+			return b
+		}
+	}
+	return nil
+}
+
+// list returns every ban that hasn't expired, oldest first.
+func (l *banList) list() []*banEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var bans []*banEntry
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			cp := *b
+			bans = append(bans, &cp)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return bans
+}
+
+// parseBanDuration parses how long a ban lasts. On top of everything
+// time.ParseDuration understands, it accepts days and weeks, like "7d".
+func parseBanDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) {
+			if n <= 0 {
+				return 0, errors.New("bans must last longer than that")
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("bans must last longer than that")
+	}
+	return d, nil
+}
+
+// ban keeps a user, IP address or CIDR range out of the server. The text of
+// the message is the target, optionally followed by how long the ban lasts
+// and the reason for it. Anyone connected who's covered by the ban is
+// disconnected.
+func (h *hub) ban(m *Message) {
+	user, ok := h.moderator(m)
+	if !ok {
+		return
+	}
+	target, rest := splitArg(m.Text)
+	if target == "" {
+		user.conn.write(newMessage("you", "server", "You need to say who to ban.\n", text))
+		return
+	}
+	b := &banEntry{
+		Target:  target,
+		By:      user.name,
+		Created: time.Now(),
+	}
+	first, reason := splitArg(rest)
+	if d, err := parseBanDuration(first); err == nil {
+		b.Expires = b.Created.Add(d)
+		b.Reason = reason
+	} else {
+		b.Reason = rest
+	}
+
+	// Whoever has the name can log in later, so it's the name's role that
+	// counts, as well as the role of anybody connected with it now.
+	victim, ok := h.users[target]
+	if outranks(h.roleFor(target), user) || ok && outranks(victim.role, user) {
+		user.conn.write(newMessage("you", "server", "You can't ban "+target+".\n", text))
+		return
+	}
+	for _, u := range h.usersCoveredBy(b) {
+		if u != user && outranks(u.role, user) {
+			user.conn.write(newMessage("you", "server", "You can't ban "+target+", since it would ban "+u.name+" too.\n", text))
+			return
+		}
+	}
+	if err := h.bans.add(b); err != nil {
+		h.logger.Println("Unable to save bans:", err.Error())
+		user.conn.write(newMessage("you", "server", "Sorry, the ban couldn't be saved.\n", text))
+		return
+	}
+	h.logger.Printf("(%s banned %s): %s", user.name, b.Target, b.Reason)
+	user.conn.write(newMessage("you", "server", b.describe()+".\n", text))
+
+	for _, u := range h.usersCoveredBy(b) {
+		if u != user {
+			user.conn.write(newMessage("you", "server", u.name+" was connected from "+u.addr+".\n", text))
+			h.disconnect(u, "You've been banned by "+user.name, b.Reason)
+		}
+	}
+}
+
+// outranks reports whether someone with role r is safe from being banned by
+// u, which moderators and admins are from anyone who isn't more senior.
+func outranks(r role, u *User) bool {
+	return r >= roleModerator && r >= u.role
+}
+
+// usersCoveredBy returns the connected users that b applies to.
+func (h *hub) usersCoveredBy(b *banEntry) []*User {
+	var users []*User
+	single := &banList{bans: map[string]*banEntry{b.Target: b}}
+	for _, u := range h.users {
+		if u.name == b.Target || single.addrBanned(u.addr) != nil {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// unban lifts a ban. The text of the message is the banned name, address or
+// range.
+func (h *hub) unban(m *Message) {
+	user, ok := h.moderator(m)
+	if !ok {
+		return
+	}
+	target := strings.TrimSpace(m.Text)
+	removed, err := h.bans.remove(target)
+	if err != nil {
+		h.logger.Println("Unable to save bans:", err.Error())
+	}
+	if !removed {
+		user.conn.write(newMessage("you", "server", target+" isn't banned.\n", text))
+		return
+	}
+	h.logger.Printf("(%s unbanned %s)", user.name, target)
+	user.conn.write(newMessage("you", "server", target+" is no longer banned.\n", text))
+}
+
+// listBans sends the sender a list of every ban.
+func (h *hub) listBans(m *Message) {
+	user, ok := h.moderator(m)
+	if !ok {
+		return
+	}
+	bans := h.bans.list()
+	if len(bans) == 0 {
+		user.conn.write(newMessage("you", "server", "Nobody is banned.\n", text))
+		return
+	}
+	var b strings.Builder
+	b.WriteString("Bans:\n")
+	for _, bn := range bans {
+		b.WriteString("  - " + bn.describe() + ", by " + bn.By + "\n")
+	}
+	user.conn.write(newMessage("you", "server", b.String(), text))
+}
+
+// moderator returns the sender of m, as long as they're a moderator.
+// Otherwise they're told they can't do that.
+func (h *hub) moderator(m *Message) (*User, bool) {
+	user, ok := h.sender(m)
+	if !ok {
+		return nil, false
+	}
+	if !h.authorize(user, permModerate) {
+		user.conn.write(newMessage("you", "server", "Only moderators can do that.\n", text))
+		return nil, false
+	}
+	return user, true
+}
+
+// disconnect tells u why they're being removed from the server, then
+// disconnects them.
+func (h *hub) disconnect(u *User, notice, reason string) {
+	if reason != "" {
+		notice += " (" + reason + ")"
+	}
+	u.conn.write(newMessage("you", "server", notice+".\n", text))
+	h.quit(newMessage(defaultChannelName, u.name, u.name+" has been removed from the server\n", quit))
+}
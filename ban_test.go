@@ -0,0 +1,33 @@
+package chat
+
+import "testing"
+
+func TestModeratorsCantBeBannedWhileAway(t *testing.T) {
+	h := startHub(t, &Config{Moderators: []string{"mod", "mona"}}, t.TempDir())
+	mod := connect(h, "mod", "mod")
+	run(h, "mod", defaultChannelName, "/ban mona")
+	if !mod.saw("You can't ban mona") {
+		t.Error("mod wasn't told they can't ban mona")
+	}
+	if h.bans.nameBanned("mona") != nil {
+		t.Error("mona was banned while they weren't connected")
+	}
+}
+
+func TestAddressBansSpareModerators(t *testing.T) {
+	h := startHub(t, &Config{Moderators: []string{"mod", "mona"}}, t.TempDir())
+	mod := connect(h, "mod", "mod")
+	connect(h, "mona", "mona")
+	run(h, "mod", defaultChannelName, "/ban 192.0.2.0/24")
+	if !mod.saw("it would ban mona too") {
+		t.Error("mod wasn't told the ban covers mona")
+	}
+	h.do(func() {
+		if _, ok := h.users["mona"]; !ok {
+			t.Error("mona was disconnected")
+		}
+	})
+	if h.bans.addrBanned("192.0.2.1") != nil {
+		t.Error("the range was banned")
+	}
+}
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"sort"
+	"time"
+)
+
+// A savedChannel is what's kept of a channel across restarts. Its history is
+// kept by the message store, but who's allowed to read it is kept here, so
+// nobody can recreate a private channel to get at it.
+type savedChannel struct {
+	Name       string
+	Mode       string
+	Key        string   `json:",omitempty"`
+	Owner      string   `json:",omitempty"`
+	Ops        []string `json:",omitempty"`
+	Invited    []string `json:",omitempty"`
+	Slowmode   int      `json:",omitempty"`
+	Topic      string   `json:",omitempty"`
+	TopicSetBy string   `json:",omitempty"`
+	TopicTime  time.Time
+}
+
+// parseMode parses the name of an access mode, as returned by its String
+// method.
+func parseMode(s string) accessMode {
+	switch s {
+	case "invite":
+		return modeInvite
+	case "key":
+		return modeKey
+	}
+	return modePublic
+}
+
+// saveChannels writes the settings of every channel to disk. It's called
+// whenever any of them change.
+func (h *hub) saveChannels() {
+	saved := make([]*savedChannel, 0, len(h.channels))
+	for _, ch := range h.channels {
+		saved = append(saved, &savedChannel{
+			Name:       ch.name,
+			Mode:       ch.mode.String(),
+			Key:        ch.key,
+			Owner:      ch.owner,
+			Ops:        sortedKeys(ch.ops),
+			Invited:    sortedKeys(ch.invited),
+			Slowmode:   int(ch.slowmode / time.Second),
+			Topic:      ch.topic,
+			TopicSetBy: ch.topicSetBy,
+			TopicTime:  ch.topicTime,
+		})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	if err := saveJSON(h.channelsPath, saved); err != nil {
+		h.logger.Println("Unable to save channels:", err.Error())
+	}
+}
+
+// restoreChannels recreates the channels saved by saveChannels. Guests lose
+// their standing in channels when they leave, and a restart means everyone
+// left, so only registered accounts keep theirs.
+func (h *hub) restoreChannels() error {
+	var saved []*savedChannel
+	if err := loadJSON(h.channelsPath, &saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		ch := h.newChannel(s.Name)
+		ch.mode = parseMode(s.Mode)
+		ch.key = s.Key
+		if h.accounts.exists(s.Owner) {
+			ch.owner = s.Owner
+		}
+		for _, id := range s.Ops {
+			if h.accounts.exists(id) {
+				ch.ops[id] = true
+			}
+		}
+		for _, id := range s.Invited {
+			if h.accounts.exists(id) {
+				ch.invited[id] = true
+			}
+		}
+		ch.slowmode = time.Duration(s.Slowmode) * time.Second
+		if s.Topic != "" {
+			ch.topic, ch.topicSetBy, ch.topicTime = s.Topic, s.TopicSetBy, s.TopicTime
+		}
+		h.channels[s.Name] = ch
+	}
+	return nil
+}
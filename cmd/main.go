@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/bentranter/chat"
@@ -19,6 +22,8 @@ var (
 	logFile       = flag.String("log", "stdout", "log filename")
 	httpPortAddr  = flag.String("http", "8000", "http port")
 	httpsPortAddr = flag.String("https", "8001", "https port")
+	dataDir       = flag.String("data", "data", "data directory")
+	addUser       = flag.String("adduser", "", "add an account with this name, reading its password from stdin, and exit")
 )
 
 func main() {
@@ -46,9 +51,21 @@ func main() {
 	if cfg.IPAddr == "" {
 		cfg.IPAddr = *ipAddr
 	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = *dataDir
+	}
+
+	if *addUser != "" {
+		if err := addAccount(cfg, *addUser); err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
 
 	logger := getLogger(cfg.LogFilename)
-	chat.ListenAndServe(logger, cfg)
+	if err := chat.ListenAndServe(logger, cfg); err != nil {
+		logger.Fatalln(err.Error())
+	}
 }
 
 func getConfig(dir string) (*chat.Config, error) {
@@ -62,9 +79,26 @@ func getConfig(dir string) (*chat.Config, error) {
 	if err != nil {
 		return cfg, err
 	}
+	cfg.ConfigFile = dir
 	return cfg, nil
 }
 
+// addAccount adds an account for name, with the password on the first line
+// of stdin. Admins and moderators can't register their own names, so this is
+// how they get accounts.
+func addAccount(cfg *chat.Config, name string) error {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := chat.AddAccount(cfg, name, strings.TrimRight(password, "\r\n")); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added an account for %s.\n", name)
+	return nil
+}
+
 func getLogger(filename string) *log.Logger {
 	prefix := "Chat: "
 	flag := log.Lshortfile | log.Ldate
@@ -0,0 +1,417 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A slashCommand is a command users can type, like "/join random". Every
+// transport sends commands to the hub as they were typed, in a command
+// message, and the hub turns them into the message they stand for.
+type slashCommand struct {
+	name string
+
+	// args describes the arguments the command takes, like
+	// "<user> [reason...]". Arguments in angle brackets are required, and
+	// ones in square brackets are optional. Each argument is a single word,
+	// unless its name ends in "...", in which case it's the rest of the
+	// text, or its closing bracket is followed by ":", in which case it's
+	// everything up to the next colon.
+	args string
+
+	// description is shown in the help, one line for each example.
+	description string
+	examples    []string
+
+	// role is the least privileged role that can use the command.
+	role role
+
+	// run carries out the command for u. The command message m says which
+	// channel u was in when they sent it.
+	run func(h *hub, u *User, m *Message, args []string)
+}
+
+// usage returns how the command is typed, like "/kick <user> [reason...]".
+func (c *slashCommand) usage() string {
+	if c.args == "" {
+		return c.name
+	}
+	return c.name + " " + c.args
+}
+
+// parse splits s into the arguments the command takes.
+func (c *slashCommand) parse(s string) ([]string, error) {
+	var args []string
+	s = strings.TrimSpace(s)
+	for _, spec := range strings.Fields(c.args) {
+		var value string
+		switch {
+		case strings.HasSuffix(spec, ":"):
+			i := strings.Index(s, ":")
+			if i == -1 {
+				return nil, errors.New("you're missing a ':'")
+			}
+			value, s = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		case strings.HasSuffix(strings.Trim(spec, "<>[]"), "..."):
+			value, s = s, ""
+		default:
+			value, s = splitArg(s)
+		}
+		if value == "" && strings.HasPrefix(spec, "<") {
+			return nil, errors.New("you're missing " + strings.TrimSuffix(spec, ":"))
+		}
+		args = append(args, value)
+	}
+	if s != "" {
+		return nil, errors.New("there's more after the last argument than it expects")
+	}
+	return args, nil
+}
+
+// slashCommands holds every command by name, and commandList holds them in
+// the order they're shown in the help. They're filled in by init, since the
+// help command needs to refer to them.
+var (
+	slashCommands map[string]*slashCommand
+	commandList   []*slashCommand
+)
+
+func init() {
+	commandList = []*slashCommand{
+		{name: "/help", description: "see this help message again", examples: []string{"/help"}, run: helpCmd},
+		{name: "/listusers", args: "[room]", description: "see all users connected", examples: []string{"/listusers"}, run: listUsersCmd},
+		{name: "/listrooms", description: "see all channels", examples: []string{"/listrooms"}, run: listRoomsCmd},
+		{name: "/newroom", args: "<room>", description: "create a new room and join it", examples: []string{"/newroom random"}, role: roleUser, run: newRoomCmd},
+		{name: "/join", args: "<room> [key]", description: "join a room\nor a room with a key", examples: []string{"/join random", "/join secret hunter2"}, run: joinRoomCmd},
+		{name: "/leave", args: "<room>", description: "leave a room", examples: []string{"/leave random"}, run: leaveRoomCmd},
+		{name: "/mute", args: "<user>", description: "mute a user", examples: []string{"/mute rob"}, run: muteCmd},
+		{name: "/unmute", args: "<user>", description: "unmute a user", examples: []string{"/unmute rob"}, run: unmuteCmd},
+		{name: "/block", args: "<user>", description: "mute a user and stop their DMs", examples: []string{"/block rob"}, run: blockCmd},
+		{name: "/unblock", args: "<user>", description: "unblock a user", examples: []string{"/unblock rob"}, run: unblockCmd},
+		{name: "/mutes", description: "list your mutes and blocks", examples: []string{"/mutes"}, run: mutesCmd},
+		{name: "/dm", args: "<user>: <message...>", description: "send a message to a user", examples: []string{"/dm rob: hello!"}, role: roleUser, run: dmCmd},
+		{name: "/history", args: "[room] [count] [cursor]", description: "see older messages in a room", examples: []string{"/history random 50"}, run: historyCmd},
+		{name: "/read", args: "[room]", description: "mark a room as read", examples: []string{"/read random"}, run: readCmd},
+		{name: "/unread", description: "see what you haven't read", examples: []string{"/unread"}, run: unreadCmd},
+		{name: "/edit", args: "<id> <message...>", description: "change one of your messages", examples: []string{"/edit 12 hello!"}, run: editCmd},
+		{name: "/delete", args: "<id>", description: "delete one of your messages", examples: []string{"/delete 12"}, run: deleteCmd},
+		{name: "/reply", args: "<id> <message...>", description: "reply to a message in a thread", examples: []string{"/reply 12 sounds good"}, run: replyCmd},
+		{name: "/react", args: "<id> <reaction>", description: "react to a message", examples: []string{"/react 12 :+1:"}, run: reactCmd(react)},
+		{name: "/unreact", args: "<id> <reaction>", description: "take back a reaction", examples: []string{"/unreact 12 :+1:"}, run: reactCmd(unreact)},
+		{name: "/topic", args: "[topic...]", description: "see or change the room's topic", examples: []string{"/topic release planning"}, run: topicCmd},
+		{name: "/op", args: "<user>", description: "make a user a room operator", examples: []string{"/op rob"}, run: userCmd(op)},
+		{name: "/deop", args: "<user>", description: "remove a room operator", examples: []string{"/deop rob"}, run: userCmd(deop)},
+		{name: "/kick", args: "<user> [reason...]", description: "remove a user from the room", examples: []string{"/kick rob being rude"}, run: userCmd(kick)},
+		{name: "/mode", args: "<mode> [key]", description: "make the room public, invite\nonly, or need a key", examples: []string{"/mode invite", "/mode key hunter2"}, run: userCmd(mode)},
+		{name: "/invite", args: "<user>", description: "invite a user to the room", examples: []string{"/invite rob"}, run: userCmd(invite)},
+		{name: "/slowmode", args: "<seconds>", description: "limit how often users can post", examples: []string{"/slowmode 30"}, run: userCmd(slowmode)},
+		{name: "/ban", args: "<who> [duration] [reason...]", description: "ban a user, IP or range, for\na while or forever", examples: []string{"/ban rob 1d spamming", "/ban 10.0.0.0/8"}, role: roleModerator, run: userCmd(ban)},
+		{name: "/unban", args: "<who>", description: "lift a ban", examples: []string{"/unban rob"}, role: roleModerator, run: userCmd(unban)},
+		{name: "/bans", description: "see everyone who's banned", examples: []string{"/bans"}, role: roleModerator, run: bansCmd},
+		{name: "/away", args: "[message...]", description: "let people know you're away", examples: []string{"/away back after lunch"}, run: presenceCmd(away)},
+		{name: "/dnd", args: "[message...]", description: "ask not to be disturbed", examples: []string{"/dnd in the zone"}, run: presenceCmd(dnd)},
+		{name: "/back", description: "let people know you're back", examples: []string{"/back"}, run: presenceCmd(back)},
+		{name: "/whois", args: "<user>", description: "see if a user is around", examples: []string{"/whois rob"}, run: whoisCmd},
+		{name: "/nick", args: "<name>", description: "change your name", examples: []string{"/nick robert"}, run: nickCmd},
+		{name: "/whowas", args: "<name>", description: "see the names a user has had", examples: []string{"/whowas rob"}, role: roleModerator, run: whowasCmd},
+		{name: "/register", description: "register your name", examples: []string{"/register"}, run: registerCmd},
+		{name: "/reload", description: "reload the content filters", examples: []string{"/reload"}, role: roleAdmin, run: reloadCmd},
+		{name: "/token", args: "<name> <scopes> [channels...]", description: "issue an API token that can\npost, read or manage", examples: []string{"/token ci post builds", "/token ci post,read builds"}, role: roleAdmin, run: userCmd(token)},
+		{name: "/tokens", description: "see every API token", examples: []string{"/tokens"}, role: roleAdmin, run: userCmd(listTokens)},
+		{name: "/revoke", args: "<id>", description: "revoke an API token", examples: []string{"/revoke 3f2a9c1b7d4e"}, role: roleAdmin, run: userCmd(revokeToken)},
+	}
+	slashCommands = make(map[string]*slashCommand, len(commandList))
+	for _, c := range commandList {
+		slashCommands[c.name] = c
+	}
+}
+
+// helpText returns the help for every command someone with role r can use.
+func helpText(r role) string {
+	var b strings.Builder
+	b.WriteString("Hello, welcome to the chat server!\nCommands:\n")
+	for _, c := range commandList {
+		if r < c.role {
+			continue
+		}
+		for i, line := range strings.Split(c.description, "\n") {
+			name := c.name
+			if i > 0 {
+				name = ""
+			}
+			example := c.examples[len(c.examples)-1]
+			if i < len(c.examples) {
+				example = c.examples[i]
+			}
+			fmt.Fprintf(&b, "  %-12s%-31s(example: %s)\n", name, line, example)
+		}
+	}
+	return b.String()
+}
+
+// A commandInfo describes a command, as returned by the API.
+type commandInfo struct {
+	Name        string
+	Usage       string
+	Description string
+	Role        string
+	Examples    []string
+}
+
+// commandInfos describes every command, in the order they're shown in the
+// help.
+func commandInfos() []commandInfo {
+	infos := make([]commandInfo, len(commandList))
+	for i, c := range commandList {
+		infos[i] = commandInfo{
+			Name:        c.name,
+			Usage:       c.usage(),
+			Description: strings.Replace(c.description, "\n", " ", -1),
+			Role:        c.role.String(),
+			Examples:    c.examples,
+		}
+	}
+	return infos
+}
+
+// command runs the command typed in the text of m. Middleware sees command
+// messages first, so custom commands can be added there, and anything that
+// makes it this far without being in the registry doesn't exist.
+func (h *hub) command(r Replier, m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	name, arg := splitArg(m.Text)
+	c, ok := slashCommands[name]
+	if !ok {
+		r.Reply("Command " + name + " doesn't exist\n")
+		return
+	}
+	if user.role < c.role {
+		r.Reply("Only " + c.role.String() + "s can use " + c.name + ".\n")
+		return
+	}
+	args, err := c.parse(arg)
+	if err != nil {
+		r.Reply(c.name + " command not understood, " + err.Error() + ". Try " + c.usage() + "\n")
+		return
+	}
+	c.run(h, user, m, args)
+}
+
+// send handles a message made by a command as if the user had sent it
+// themselves, so it's rate limited and seen by middleware like any other.
+func (h *hub) send(cmd, m *Message) {
+	m.addr = cmd.addr
+	m.session = cmd.session
+	if !h.allow(m) {
+		return
+	}
+	h.handler.ServeMessage(replier{h, m.Username, m.session}, m)
+}
+
+func helpCmd(h *hub, u *User, _ *Message, _ []string) {
+	u.conn.write(newMessage("you", "server", helpText(u.role), text))
+}
+
+func listUsersCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "", listUsers))
+}
+
+func listRoomsCmd(h *hub, u *User, m *Message, _ []string) {
+	h.send(m, newMessage("", u.name, "", listChannels))
+}
+
+func newRoomCmd(h *hub, u *User, m *Message, args []string) {
+	if args[0] == m.Channel {
+		u.conn.write(newMessage("you", "server", "You're already in that room\n", text))
+		return
+	}
+	h.send(m, newMessage(args[0], u.name, u.name+" created new channel "+args[0], create))
+}
+
+func joinRoomCmd(h *hub, u *User, m *Message, args []string) {
+	if args[0] == m.Channel {
+		u.conn.write(newMessage("you", "server", "You're already in that room\n", text))
+		return
+	}
+	h.send(m, newMessage(args[0], u.name, args[1], join))
+}
+
+func leaveRoomCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, u.name+" left channel "+args[0], leave))
+}
+
+func muteCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "Muted user "+args[0]+".\n", mute))
+}
+
+// presenceCmd returns a command that sets the user's presence with a
+// message of type t, which is away, dnd or back.
+func presenceCmd(t MessageType) func(h *hub, u *User, m *Message, args []string) {
+	return func(h *hub, u *User, m *Message, args []string) {
+		var s string
+		if len(args) > 0 {
+			s = args[0]
+		}
+		h.send(m, newMessage("", u.name, s, t))
+	}
+}
+
+func whoisCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "", whois))
+}
+
+func nickCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "", nick))
+}
+
+func whowasCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "", whowas))
+}
+
+func unmuteCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "Unmuted user "+args[0]+".\n", unmute))
+}
+
+func blockCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "Blocked user "+args[0]+".\n", block))
+}
+
+func unblockCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(args[0], u.name, "Unblocked user "+args[0]+".\n", unblock))
+}
+
+func mutesCmd(h *hub, u *User, m *Message, _ []string) {
+	h.send(m, newMessage("", u.name, "", listMutes))
+}
+
+func dmCmd(h *hub, u *User, m *Message, args []string) {
+	if args[0] == u.name {
+		u.conn.write(newMessage("you", "server", "You can't send a dm to yourself.\n", text))
+		return
+	}
+	h.send(m, newMessage(args[0], u.name, args[1], dm))
+}
+
+// historyCmd asks for messages from a room's history. It takes an optional
+// room name, number of messages, and cursor to read back from, which is how
+// the command printed at the end of each page fetches the one before it.
+func historyCmd(h *hub, u *User, m *Message, args []string) {
+	room := m.Channel
+	if _, err := strconv.Atoi(args[0]); args[0] != "" && err != nil {
+		room, args = args[0], args[1:]
+	} else if args[2] != "" {
+		u.conn.write(newMessage("you", "server", "/history command not understood. Try /history [room] [count] [cursor]\n", text))
+		return
+	}
+
+	hm := newMessage(room, u.name, args[0], history)
+	if args[1] != "" {
+		cursor, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			u.conn.write(newMessage("you", "server", "/history command not understood, "+args[1]+" isn't a valid place in the history.\n", text))
+			return
+		}
+		hm.Cursor = cursor
+	}
+	h.send(m, hm)
+}
+
+func readCmd(h *hub, u *User, m *Message, args []string) {
+	room := args[0]
+	if room == "" {
+		room = m.Channel
+	}
+	h.send(m, newMessage(room, u.name, "", markRead))
+}
+
+func unreadCmd(h *hub, u *User, m *Message, _ []string) {
+	h.send(m, newMessage("", u.name, "", unread))
+}
+
+func editCmd(h *hub, u *User, m *Message, args []string) {
+	sendTargeted(h, u, m, "/edit", args[0], args[1]+"\n", edit)
+}
+
+func deleteCmd(h *hub, u *User, m *Message, args []string) {
+	sendTargeted(h, u, m, "/delete", args[0], "", remove)
+}
+
+func replyCmd(h *hub, u *User, m *Message, args []string) {
+	id, ok := parseMessageID(args[0])
+	if !ok {
+		u.conn.write(newMessage("you", "server", "/reply command not understood, "+args[0]+" isn't the number of a message.\n", text))
+		return
+	}
+	rm := newMessage(m.Channel, u.name, args[1]+"\n", text)
+	rm.ReplyTo = id
+	h.send(m, rm)
+}
+
+// reactCmd returns a command that sends a reaction of type t, which is
+// either react or unreact.
+func reactCmd(t MessageType) func(h *hub, u *User, m *Message, args []string) {
+	return func(h *hub, u *User, m *Message, args []string) {
+		sendTargeted(h, u, m, "/"+t.String(), args[0], args[1], t)
+	}
+}
+
+// sendTargeted sends a message that acts on the message with the given ID.
+func sendTargeted(h *hub, u *User, m *Message, name, id, s string, t MessageType) {
+	target, ok := parseMessageID(id)
+	if !ok {
+		u.conn.write(newMessage("you", "server", name+" command not understood, "+id+" isn't the number of a message.\n", text))
+		return
+	}
+	tm := newMessage(m.Channel, u.name, s, t)
+	tm.Target = target
+	h.send(m, tm)
+}
+
+func topicCmd(h *hub, u *User, m *Message, args []string) {
+	h.send(m, newMessage(m.Channel, u.name, args[0], topic))
+}
+
+// userCmd returns a command that sends a message of type t to the current
+// room, with all of its arguments as the text. Most of them act on another
+// user, whose name comes first.
+func userCmd(t MessageType) func(h *hub, u *User, m *Message, args []string) {
+	return func(h *hub, u *User, m *Message, args []string) {
+		var words []string
+		for _, arg := range args {
+			if arg != "" {
+				words = append(words, arg)
+			}
+		}
+		h.send(m, newMessage(m.Channel, u.name, strings.Join(words, " "), t))
+	}
+}
+
+func bansCmd(h *hub, u *User, m *Message, _ []string) {
+	h.send(m, newMessage("", u.name, "", listBans))
+}
+
+// registerCmd tells users how to send their password. Over TCP, /register
+// never gets here, because the connection asks for the password itself, so it
+// isn't echoed.
+func registerCmd(h *hub, u *User, m *Message, _ []string) {
+	u.conn.write(newMessage("you", "server", "To register your name, send a message with a MessageType of "+strconv.Itoa(int(register))+" and your password as its Text.\n", text))
+}
+
+func reloadCmd(h *hub, u *User, m *Message, _ []string) {
+	h.send(m, newMessage("", u.name, "", reload))
+}
+
+// parseMessageID parses the ID of a message as it's shown to users, with or
+// without its leading #.
+func parseMessageID(s string) (uint64, bool) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "#"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A FilterConfig describes words and patterns that aren't allowed in
+// messages, and what to do about messages that contain them.
+type FilterConfig struct {
+	// Words are matched as whole words, ignoring case. Patterns are regular
+	// expressions, matched as they're written.
+	Words    []string
+	Patterns []string
+
+	// Action is "mask" to replace whatever matched with asterisks, "reject"
+	// to refuse to send the message, or "flag" to send it, but let the
+	// moderators know.
+	Action string
+
+	// Channels are the channels the filter applies to. If it's empty, the
+	// filter applies everywhere, including to direct messages.
+	Channels []string
+}
+
+// A filterAction is what happens to a message that matches a filter.
+type filterAction int
+
+const (
+	filterMask filterAction = iota
+	filterReject
+	filterFlag
+)
+
+// parseFilterAction parses the name of an action, as used in the config.
+func parseFilterAction(s string) (filterAction, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "mask":
+		return filterMask, nil
+	case "reject":
+		return filterReject, nil
+	case "flag":
+		return filterFlag, nil
+	}
+	return filterMask, errors.New("unknown filter action " + s)
+}
+
+// A filter is a compiled FilterConfig.
+type filter struct {
+	patterns []*regexp.Regexp
+	action   filterAction
+	channels map[string]bool
+}
+
+// newFilters compiles the filters in cfgs.
+func newFilters(cfgs []FilterConfig) ([]*filter, error) {
+	filters := make([]*filter, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		action, err := parseFilterAction(cfg.Action)
+		if err != nil {
+			return nil, err
+		}
+		f := &filter{action: action}
+		if len(cfg.Words) > 0 {
+			words := make([]string, len(cfg.Words))
+			for i, w := range cfg.Words {
+				words[i] = regexp.QuoteMeta(w)
+			}
+			f.patterns = append(f.patterns, regexp.MustCompile(`(?i)\b(?:`+strings.Join(words, "|")+`)\b`))
+		}
+		for _, p := range cfg.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, err
+			}
+			f.patterns = append(f.patterns, re)
+		}
+		if len(cfg.Channels) > 0 {
+			f.channels = make(map[string]bool, len(cfg.Channels))
+			for _, name := range cfg.Channels {
+				f.channels[name] = true
+			}
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// appliesTo reports whether f filters messages sent to the named channel. An
+// empty name means a direct message.
+func (f *filter) appliesTo(channel string) bool {
+	if f.channels == nil {
+		return true
+	}
+	return channel != "" && f.channels[channel]
+}
+
+func (f *filter) matches(s string) bool {
+	for _, re := range f.patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) mask(s string) string {
+	for _, re := range f.patterns {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			return strings.Repeat("*", len([]rune(match)))
+		})
+	}
+	return s
+}
+
+// filterMessages is the middleware that applies the content filters to
+// everything users write: channel messages, direct messages and edits.
+func (h *hub) filterMessages(next Handler) Handler {
+	return HandlerFunc(func(r Replier, m *Message) {
+		var channel string
+		switch m.MessageType {
+		case text:
+			channel = m.Channel
+			// A reply is sent to whichever channel the message it replies
+			// to is in, no matter which one it says, so it's moved there
+			// before it's checked.
+			if m.ReplyTo > 0 {
+				parent, err := h.store.Message(m.ReplyTo)
+				if err != nil {
+					next.ServeMessage(r, m)
+					return
+				}
+				m.Channel = parent.Channel
+				channel = parent.Channel
+			}
+		case dm:
+		case edit:
+			// An edit's channel is whichever one the message it changes was
+			// sent to.
+			target, err := h.store.Message(m.Target)
+			if err != nil {
+				next.ServeMessage(r, m)
+				return
+			}
+			if target.MessageType != dm {
+				channel = target.Channel
+			}
+		default:
+			next.ServeMessage(r, m)
+			return
+		}
+
+		var flagged bool
+		for _, f := range h.filters {
+			if !f.appliesTo(channel) || !f.matches(m.Text) {
+				continue
+			}
+			switch f.action {
+			case filterReject:
+				h.logger.Printf("(filter rejected a message from %s to %s): %s", m.Username, m.Channel, strings.TrimRight(m.Text, "\n"))
+				r.Reply("Your message to " + m.Channel + " wasn't sent, because it contains something that isn't allowed here.\n")
+				return
+			case filterMask:
+				m.Text = f.mask(m.Text)
+			case filterFlag:
+				flagged = true
+			}
+		}
+		if flagged {
+			h.flag(m)
+		}
+		next.ServeMessage(r, m)
+	})
+}
+
+// flag tells every moderator who's online about m.
+func (h *hub) flag(m *Message) {
+	notice := "Flagged message from " + m.Username + " to " + m.Channel + ": " + strings.TrimRight(m.Text, "\n") + "\n"
+	h.logger.Printf("(%s)", strings.TrimRight(notice, "\n"))
+	for _, u := range h.users {
+		if h.authorize(u, permModerate) {
+			u.conn.write(newMessage("you", "server", notice, text))
+		}
+	}
+}
+
+// reloadFilters reads the filters from the config file again, and starts
+// using them if they're valid. It must be called from the run loop.
+func (h *hub) reloadFilters() error {
+	if h.cfg.ConfigFile == "" {
+		return errors.New("the server wasn't started with a config file")
+	}
+	cfg := &Config{}
+	if _, err := toml.DecodeFile(h.cfg.ConfigFile, cfg); err != nil {
+		return err
+	}
+	filters, err := newFilters(cfg.Filters)
+	if err != nil {
+		return err
+	}
+	h.cfg.Filters = cfg.Filters
+	h.filters = filters
+	h.logger.Printf("(reloaded %d filters from %s)", len(filters), h.cfg.ConfigFile)
+	return nil
+}
+
+// reload reloads the filters for an admin.
+func (h *hub) reload(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.authorize(user, permAdmin) {
+		user.conn.write(newMessage("you", "server", "Only admins can do that.\n", text))
+		return
+	}
+	if err := h.reloadFilters(); err != nil {
+		user.conn.write(newMessage("you", "server", "Couldn't reload the filters: "+err.Error()+"\n", text))
+		return
+	}
+	user.conn.write(newMessage("you", "server", "Reloaded the filters.\n", text))
+}
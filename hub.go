@@ -1,23 +1,31 @@
 package chat
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
-type messageType int
+// A MessageType says what a message is for, such as a chat message, a
+// direct message or a request to join a channel. Its String method returns
+// the name used for it in the config.
+type MessageType int
 
 const (
 	defaultChannelName = "general"
 
-	join = messageType(iota)
+	join = MessageType(iota)
 	listUsers
 	listChannels
 	create
@@ -27,6 +35,110 @@ const (
 	unmute
 	dm
 	quit
+	history
+	edit
+	remove
+	react
+	unreact
+	topic
+	op
+	deop
+	kick
+	mode
+	invite
+	ban
+	unban
+	listBans
+	slowmode
+	command
+	reload
+	listMutes
+	block
+	unblock
+	register
+	token
+	listTokens
+	revokeToken
+	nick
+	whowas
+	away
+	dnd
+	back
+	whois
+	typing
+	markRead
+	unread
+)
+
+// messageTypeNames are the names of each message type, as used in the config.
+var messageTypeNames = map[MessageType]string{
+	join:         "join",
+	listUsers:    "listusers",
+	listChannels: "listrooms",
+	create:       "newroom",
+	leave:        "leave",
+	text:         "text",
+	mute:         "mute",
+	unmute:       "unmute",
+	dm:           "dm",
+	quit:         "quit",
+	history:      "history",
+	edit:         "edit",
+	remove:       "delete",
+	react:        "react",
+	unreact:      "unreact",
+	topic:        "topic",
+	op:           "op",
+	deop:         "deop",
+	kick:         "kick",
+	mode:         "mode",
+	invite:       "invite",
+	ban:          "ban",
+	unban:        "unban",
+	listBans:     "bans",
+	slowmode:     "slowmode",
+	command:      "command",
+	reload:       "reload",
+	listMutes:    "mutes",
+	block:        "block",
+	unblock:      "unblock",
+	register:     "register",
+	token:        "token",
+	listTokens:   "tokens",
+	revokeToken:  "revoke",
+	nick:         "nick",
+	whowas:       "whowas",
+	away:         "away",
+	dnd:          "dnd",
+	back:         "back",
+	whois:        "whois",
+	typing:       "typing",
+	markRead:     "read",
+	unread:       "unread",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+const (
+	// defaultScrollback is the number of messages sent to users joining a
+	// channel when the config doesn't say otherwise.
+	defaultScrollback = 20
+
+	// defaultHistoryLimit and maxHistoryLimit bound the number of messages
+	// returned by a single request for history.
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 200
+
+	// maxReactionLength is the longest a reaction to a message can be.
+	maxReactionLength = 32
+
+	// maxTopicLength is the longest a channel's topic can be.
+	maxTopicLength = 300
 )
 
 // A Config sets the options the server needs when it starts.
@@ -37,26 +149,172 @@ type Config struct {
 	HTTPSPortAddr string
 	IPAddr        string
 	LogFilename   string
+
+	// DataDir is where the server keeps anything it needs to remember
+	// between restarts, such as message history. If it's empty, nothing is
+	// persisted.
+	DataDir string
+
+	// Scrollback is the number of messages from a channel's history that are
+	// sent to users when they join it. Zero means the default of 20, and a
+	// negative number turns scrollback off.
+	Scrollback int
+
+	// Channels holds settings for individual channels, keyed by name.
+	Channels map[string]ChannelConfig
+
+	// Admins and Moderators are the names of the users with those roles.
+	// Moderators can manage every channel, and admins can also manage the
+	// server.
+	Admins     []string
+	Moderators []string
+
+	// DefaultRole is the role of everyone else. It's "user" if it isn't set,
+	// or it can be "guest" to stop people from creating channels or sending
+	// direct messages.
+	DefaultRole string
+
+	// RequireLogin stops people from connecting without logging in to a
+	// registered account. Otherwise, anyone can use a name nobody has
+	// registered. Either way, Admins and Moderators only get their roles
+	// once they've logged in.
+	RequireLogin bool
+
+	// Flood limits how quickly messages can be sent.
+	Flood FloodConfig
+
+	// Filters stop, mask or flag messages with words that aren't allowed.
+	Filters []FilterConfig
+
+	// ConfigFile is the file the config was read from. When it's set, the
+	// filters are read from it again when the server gets a SIGHUP, or when
+	// an admin asks for them to be reloaded.
+	ConfigFile string `toml:"-"`
+}
+
+// A ChannelConfig overrides the server-wide settings for a single channel.
+type ChannelConfig struct {
+	// Scrollback overrides Config.Scrollback when it isn't zero.
+	Scrollback int
+
+	// Topic is the channel's topic when it's created.
+	Topic string
 }
 
-// A message contains the information needed for the server and clients to
+// A Message contains the information needed for the server and clients to
 // communicate.
-type message struct {
+type Message struct {
 	Channel     string
 	Username    string
 	Text        string
 	Time        time.Time
-	MessageType messageType
+	MessageType MessageType
+
+	// ID uniquely identifies a message across the whole server, and Seq is
+	// its position in its channel, counting up from one with no gaps. Only
+	// messages that are kept in the history have them. In a request for
+	// history, Seq asks for the messages after it, so clients can catch up
+	// on anything they missed.
+	ID  uint64 `json:",omitempty"`
+	Seq uint64 `json:",omitempty"`
+
+	// Target is the ID of the message that an edit or remove applies to.
+	Target uint64 `json:",omitempty"`
+
+	// ReplyTo is the ID of the message that starts the thread a message is
+	// a reply to. Replies to replies all end up in the same thread.
+	ReplyTo uint64 `json:",omitempty"`
+
+	// Edited and Deleted are set on stored messages that have since been
+	// changed by an edit or remove.
+	Edited  bool `json:",omitempty"`
+	Deleted bool `json:",omitempty"`
+
+	// Reactions maps each reaction to a stored message to the users who
+	// reacted with it. A react or unreact sent out by the hub carries the
+	// updated reactions of the message it targets.
+	Reactions map[string][]string `json:",omitempty"`
+
+	// History holds the messages being replayed to a user by a history
+	// message.
+	History []*Message `json:",omitempty"`
+
+	// Cursor marks a place in a channel's history. When asking for history
+	// it's where to start reading back from, and in the reply it's where to
+	// continue from to read further back.
+	Cursor uint64 `json:",omitempty"`
+
+	// Author is who sent a stored message, as far as changing it later goes.
+	// It's the account they were logged in to, or the API token they used,
+	// and it's empty for guests, since their names can be taken by anybody
+	// once they've gone.
+	Author string `json:",omitempty"`
+
+	// Meta holds annotations added by middleware. The hub doesn't look at
+	// it, but it's kept with the message and sent on to websocket clients.
+	Meta map[string]string `json:",omitempty"`
+
+	// addr is the address the message was sent from, if it didn't come from
+	// a connected user.
+	addr string
+
+	// from is the name the message's sender logged in with, as stamped by
+	// the transport it came from. Clients can't set it, so it's what the
+	// hub trusts instead of Username.
+	from string
+
+	// session is the sender of a message sent through the API. It's made
+	// from the request's credential and only lasts while the message is
+	// handled, so the message is never handled as whoever happens to be
+	// connected with the same name.
+	session *User
 }
 
-func newMessage(channel, username, text string, messageType messageType) *message {
-	return &message{
+func newMessage(channel, username, text string, t MessageType) *Message {
+	return &Message{
 		Channel:     channel,
 		Username:    username,
 		Text:        text,
 		Time:        time.Now(),
-		MessageType: messageType,
+		MessageType: t,
+	}
+}
+
+// clearServerFields clears everything in m that only the hub is allowed to
+// set, and stamps it with the time it arrived, so clients can't forge
+// reactions, edits or history, or backdate what they send.
+func (m *Message) clearServerFields() {
+	m.Time = time.Now()
+	m.ID = 0
+	m.Author = ""
+	m.Edited = false
+	m.Deleted = false
+	m.Reactions = nil
+	m.History = nil
+	m.Meta = nil
+}
+
+// An accessMode controls who can join a channel.
+type accessMode int
+
+const (
+	// Anyone can join a public channel.
+	modePublic accessMode = iota
+	// Only users invited by an operator can join an invite only channel, and
+	// it's hidden from everyone else.
+	modeInvite
+	// Users need to know the key to join a keyed channel.
+	modeKey
+)
+
+func (a accessMode) String() string {
+	switch a {
+	case modeInvite:
+		return "invite"
+	case modeKey:
+		return "key"
 	}
+	return "public"
 }
 
 // A channel is the equivalent of a "chat room", containing a name,
@@ -65,30 +323,180 @@ type channel struct {
 	name        string
 	users       map[*User]bool
 	activeUsers map[string]*User
+	store       MessageStore
+	scrollback  int
+
+	// owner is the name of the user who created the channel. They're always
+	// an operator, along with anyone in ops.
+	owner string
+	ops   map[string]bool
+
+	mode    accessMode
+	key     string
+	invited map[string]bool
+
+	// slowmode is how long each user has to wait between posts, and
+	// lastPost is when each user last posted.
+	slowmode time.Duration
+	lastPost map[string]time.Time
+
+	topic      string
+	topicSetBy string
+	topicTime  time.Time
 }
 
-func newChannel(channelName string, activeUsers map[string]*User) *channel {
+func newChannel(channelName string, activeUsers map[string]*User, store MessageStore, scrollback int) *channel {
 	return &channel{
 		name:        channelName,
 		users:       make(map[*User]bool),
 		activeUsers: activeUsers,
+		store:       store,
+		scrollback:  scrollback,
+		ops:         make(map[string]bool),
+		invited:     make(map[string]bool),
+		lastPost:    make(map[string]time.Time),
 	}
 }
 
+// canJoin returns an error explaining why the user can't join the channel,
+// or nil if they can. Operators and invited users can always join.
+func (c *channel) canJoin(u *User, key string) error {
+	if c.users[u] || c.isOperator(u.id()) || c.invited[u.id()] {
+		return nil
+	}
+	switch c.mode {
+	case modeInvite:
+		return errors.New("The channel " + c.name + " is invite only.")
+	case modeKey:
+		if key == "" {
+			return errors.New("The channel " + c.name + " needs a key. Try /join " + c.name + " <key>.")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(c.key)) != 1 {
+			return errors.New("That's not the key for " + c.name + ".")
+		}
+	}
+	return nil
+}
+
+// visibleTo reports whether u can see that the channel exists. Invite only
+// channels are hidden from anyone who couldn't join them.
+func (c *channel) visibleTo(u *User) bool {
+	return c.mode != modeInvite || c.users[u] || c.isOperator(u.id()) || c.invited[u.id()]
+}
+
+// readableBy reports whether u can read the channel's history. Anyone can
+// read a public channel, but otherwise only its members can, along with API
+// sessions whose token names it. Tokens limited to other channels can't be
+// used to read it at all.
+func (c *channel) readableBy(u *User) bool {
+	if !u.mayUse(c.name) {
+		return false
+	}
+	return c.mode == modePublic || c.users[u] || u.credential != nil && u.credential.channels[c.name]
+}
+
+// isOperator reports whether the user with the given ID can manage the
+// channel.
+func (c *channel) isOperator(id string) bool {
+	return id == c.owner || c.ops[id]
+}
+
+// forget takes away everything the user with the given ID was given in the
+// channel, reporting whether there was anything. It's used when guests
+// leave, so whoever picks their name next doesn't get it too.
+func (c *channel) forget(id string) bool {
+	had := c.owner == id || c.ops[id] || c.invited[id]
+	if c.owner == id {
+		c.owner = ""
+	}
+	delete(c.ops, id)
+	delete(c.invited, id)
+	return had
+}
+
+// setTopic changes the channel's topic, remembering who changed it and when.
+func (c *channel) setTopic(topic, username string) {
+	c.topic = topic
+	c.topicSetBy = username
+	c.topicTime = time.Now()
+}
+
+// topicMessage returns a message describing the channel's topic.
+func (c *channel) topicMessage() *Message {
+	m := newMessage(c.name, c.topicSetBy, c.topic, topic)
+	if !c.topicTime.IsZero() {
+		m.Time = c.topicTime
+	}
+	return m
+}
+
+// A channelInfo describes a channel to API clients.
+type channelInfo struct {
+	Name       string
+	Mode       string
+	Topic      string     `json:",omitempty"`
+	TopicSetBy string     `json:",omitempty"`
+	TopicTime  *time.Time `json:",omitempty"`
+	Users      int
+
+	// SlowMode is how many seconds users have to wait between posts.
+	SlowMode int `json:",omitempty"`
+}
+
+func (c *channel) info() *channelInfo {
+	info := &channelInfo{
+		Name:       c.name,
+		Mode:       c.mode.String(),
+		SlowMode:   int(c.slowmode / time.Second),
+		Topic:      c.topic,
+		TopicSetBy: c.topicSetBy,
+		Users:      len(c.users),
+	}
+	if !c.topicTime.IsZero() {
+		t := c.topicTime
+		info.TopicTime = &t
+	}
+	return info
+}
+
 func (c *channel) join(u *User) {
 	if _, ok := c.users[u]; ok {
 		u.conn.write(newMessage(c.name, u.name, "Changing to channel "+c.name+"\n", join))
 		return
 	}
 	c.users[u] = true
+	if c.topic != "" {
+		u.conn.write(c.topicMessage())
+	}
+	c.replay(u)
 	c.broadcast(newMessage(c.name, u.name, u.name+" has joined "+c.name+"\n", join))
 }
 
+// replay sends u the most recent messages in the channel's history, so they
+// have some idea of what's being talked about.
+func (c *channel) replay(u *User) {
+	if c.scrollback <= 0 {
+		return
+	}
+	msgs, next, err := c.store.Page(c.name, 0, c.scrollback)
+	if err != nil {
+		log.Println("Replay error: ", err.Error())
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	m := newMessage(c.name, "server", "", history)
+	m.History = msgs
+	m.Cursor = next
+	u.conn.write(m)
+}
+
 func (c *channel) leave(u *User) {
 	delete(c.users, u)
 }
 
-func (c *channel) broadcast(m *message) {
+func (c *channel) broadcast(m *Message) {
 	for u := range c.users {
 		if _, ok := c.activeUsers[u.name]; !ok {
 			continue
@@ -105,42 +513,92 @@ func (c *channel) broadcast(m *message) {
 // clients, and sends and receives messages, essentially acting as a message
 // broker.
 type hub struct {
-	logger    *log.Logger
-	channels  map[string]*channel
-	users     map[string]*User
-	userCh    chan *User
-	messageCh chan *message
+	funcCh   chan func()
+	logger   *log.Logger
+	cfg      *Config
+	store    MessageStore
+	handler  Handler
+	filters  []*filter
+	bans     *banList
+	ignores  *ignoreList
+	names    *nameHistory
+	reserved map[string]*reservation
+	apiSeen  map[string]time.Time
+	typists  map[typingKey]*typingState
+	markers  *readMarkers
+
+	// channelsPath is where the settings of every channel are saved.
+	channelsPath string
+	accounts     *accountStore
+	tokens       *tokenStore
+	limiter      *limiter
+	lastID       uint64
+	seqs         map[string]uint64
+	channels     map[string]*channel
+	users        map[string]*User
+	userCh       chan *User
+	messageCh    chan *Message
 }
 
-func newHub(l *log.Logger) *hub {
-	return &hub{
+// newHub returns a hub that passes every message through mws before acting
+// on it. The content filters come last, so they see messages after any
+// changes made by mws.
+func newHub(l *log.Logger, cfg *Config, store MessageStore, mws ...Middleware) *hub {
+	h := &hub{
+		funcCh:    make(chan func()),
 		logger:    l,
+		cfg:       cfg,
+		store:     store,
+		seqs:      make(map[string]uint64),
 		channels:  make(map[string]*channel),
 		users:     make(map[string]*User),
+		reserved:  make(map[string]*reservation),
+		apiSeen:   make(map[string]time.Time),
+		typists:   make(map[typingKey]*typingState),
 		userCh:    make(chan *User),
-		messageCh: make(chan *message),
+		messageCh: make(chan *Message),
 	}
+	h.handler = chain(HandlerFunc(h.dispatch), append(mws[:len(mws):len(mws)], h.filterMessages))
+	return h
 }
 
 func (h *hub) newUser(u *User) {
+	// Two people can pick the same name at once, since they're both
+	// checked before either joins.
+	if _, ok := h.users[u.name]; ok || h.reservedFor(u.name, nil) {
+		u.conn.write(newMessage("you", "server", "Sorry, the name "+u.name+" was taken while you were connecting.\n", text))
+		u.conn.close()
+		return
+	}
+	u.role = h.roleFor(u.account)
+	u.connected = time.Now()
+	u.lastActive = u.connected
+	u.conn = &ignoringConn{connection: u.conn, h: h, u: u}
 	h.users[u.name] = u
+	u.conn.write(newMessage(defaultChannelName, u.name, helpText(u.role), text))
 	h.channels[defaultChannelName].join(u)
+	h.startReading(u, h.channels[defaultChannelName])
 	go u.conn.read()
 }
 
-func (h *hub) listUsers(m *message) {
-	user, ok := h.users[m.Username]
+func (h *hub) listUsers(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
 	var users []string
 	if m.Channel != "" {
 		ch, ok := h.channels[m.Channel]
-		if !ok {
+		if !ok || !ch.visibleTo(user) {
 			user.conn.write(newMessage("you", "server", "Channel "+m.Channel+" doesn't exist.\n", text))
 			return
 		}
+		// Operators are marked with an @, like they are on IRC.
 		for u := range ch.users {
+			if ch.isOperator(u.id()) {
+				users = append(users, "@"+u.name)
+				continue
+			}
 			users = append(users, u.name)
 		}
 	} else {
@@ -152,26 +610,41 @@ func (h *hub) listUsers(m *message) {
 	user.conn.write(m)
 }
 
-func (h *hub) listChannels(m *message) {
-	user, ok := h.users[m.Username]
+func (h *hub) listChannels(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
 	var chans []string
-	for ch := range h.channels {
-		chans = append(chans, ch)
+	for name, ch := range h.channels {
+		if !ch.visibleTo(user) {
+			continue
+		}
+		switch ch.mode {
+		case modeInvite:
+			name += " (invite only)"
+		case modeKey:
+			name += " (key)"
+		}
+		if ch.topic != "" {
+			name += " - " + ch.topic
+		}
+		chans = append(chans, name)
 	}
-	m.Text = strings.Join(chans, ",")
+	sort.Strings(chans)
+	m.Text = strings.Join(chans, "\n")
 	user.conn.write(m)
 }
 
-func (h *hub) joinChannel(m *message) {
-	user, ok := h.users[m.Username]
+// joinChannel adds the sender to a channel. The text of the message is the
+// channel's key, if it needs one.
+func (h *hub) joinChannel(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
-	if ch, ok := h.channels[m.Channel]; ok {
-		ch.join(user)
+	if ch, ok := h.channels[m.Channel]; ok && ch.visibleTo(user) {
+		h.joinExisting(user, ch, strings.TrimSpace(m.Text))
 		return
 	}
 	m.Text = "Sorry, the channel " + m.Channel + " doesn't exist.\n"
@@ -179,8 +652,18 @@ func (h *hub) joinChannel(m *message) {
 	user.conn.write(m)
 }
 
-func (h *hub) leaveChannel(m *message) {
-	user, ok := h.users[m.Username]
+// joinExisting adds u to ch, as long as they're allowed in.
+func (h *hub) joinExisting(u *User, ch *channel, key string) {
+	if err := ch.canJoin(u, key); err != nil {
+		u.conn.write(newMessage("you", "server", err.Error()+"\n", text))
+		return
+	}
+	ch.join(u)
+	h.startReading(u, ch)
+}
+
+func (h *hub) leaveChannel(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
@@ -208,64 +691,260 @@ func (h *hub) leaveChannel(m *message) {
 	user.conn.write(m)
 }
 
-func (h *hub) createChannel(m *message) {
-	user, ok := h.users[m.Username]
+func (h *hub) createChannel(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
 	ch, ok := h.channels[m.Channel]
+	if ok && !ch.visibleTo(user) {
+		user.conn.write(newMessage("you", "server", "Sorry, the channel "+m.Channel+" doesn't exist.\n", text))
+		return
+	}
 	if ok {
-		ch.join(user)
+		h.joinExisting(user, ch, "")
 		return
 	}
-	newCh := newChannel(m.Channel, h.users)
+	if !h.authorize(user, permCreateChannel) {
+		m.Text = "Guests can't create channels.\n"
+		m.MessageType = text
+		user.conn.write(m)
+		return
+	}
+	// Direct message logs are named after the two users with an @ prefix,
+	// so channels can't be, or they could end up sharing a log.
+	if strings.HasPrefix(m.Channel, "@") {
+		m.Text = "Channel names can't start with @.\n"
+		m.MessageType = text
+		user.conn.write(m)
+		return
+	}
+	// A channel with history, but no saved settings, could have been
+	// private, so only moderators can bring it back.
+	if seq, err := h.lastSeq(m.Channel); (err != nil || seq > 0) && !h.authorize(user, permModerate) {
+		user.conn.write(newMessage("you", "server", "The channel "+m.Channel+" has history from before, so only a moderator can create it again.\n", text))
+		return
+	}
+	newCh := h.newChannel(m.Channel)
+	newCh.owner = user.id()
 	h.channels[m.Channel] = newCh
+	h.saveChannels()
 	newCh.join(user)
+	h.startReading(user, newCh)
 }
 
-func (h *hub) broadcast(m *message) {
-	h.logger.Printf("(%s to %s): %s", m.Username, m.Channel, m.Text)
+// newChannel returns a new channel with the given name, set up according to
+// the config.
+func (h *hub) newChannel(name string) *channel {
+	ch := newChannel(name, h.users, h.store, h.scrollback(name))
+	if t := h.cfg.Channels[name].Topic; t != "" {
+		ch.setTopic(t, "server")
+	}
+	return ch
+}
+
+// scrollback returns the number of messages to replay to users joining the
+// named channel.
+func (h *hub) scrollback(name string) int {
+	n := h.cfg.Scrollback
+	if chCfg, ok := h.cfg.Channels[name]; ok && chCfg.Scrollback != 0 {
+		n = chCfg.Scrollback
+	}
+	if n == 0 {
+		n = defaultScrollback
+	}
+	return n
+}
+
+func (h *hub) broadcast(m *Message) {
+	var parent *Message
+	if m.ReplyTo > 0 {
+		if parent = h.replyParent(m); parent == nil {
+			return
+		}
+	}
 	ch, ok := h.channels[m.Channel]
 	if !ok {
 		return
 	}
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !user.mayUse(ch.name) {
+		user.conn.write(newMessage("you", "server", "You aren't allowed to use that token in "+ch.name+".\n", text))
+		return
+	}
+	if !h.canPost(user, ch) {
+		user.conn.write(newMessage("you", "server", "You're not a member of the channel "+ch.name+".\n", text))
+		return
+	}
+	connected := user.credential == nil
+	// API senders are kept to the same pace, by the name they post as.
+	if ch.slowmode > 0 && !h.isOperator(user, ch) {
+		now := time.Now()
+		if wait := ch.lastPost[user.name].Add(ch.slowmode).Sub(now); wait > 0 {
+			user.conn.write(newMessage("you", "server", "Slow mode is on in "+ch.name+". You can post again in "+wait.Round(time.Second).String()+".\n", text))
+			return
+		}
+		ch.lastPost[user.name] = now
+	}
+	if connected {
+		h.stopTyping(user, ch.name)
+	}
+	h.logger.Printf("(%s to %s): %s", m.Username, m.Channel, m.Text)
+	m.Author = user.author()
+	h.record(m)
+	if m.Author == "" {
+		if user.sent == nil {
+			user.sent = make(map[uint64]bool)
+		}
+		user.sent[m.ID] = true
+	}
+	// Anyone who posts has read everything before it.
+	if connected {
+		h.markers.advance(user.name, ch.name, m.Seq)
+	}
 	ch.broadcast(m)
+	if parent != nil {
+		h.notifyReply(m, parent)
+	}
 }
 
-func (h *hub) mute(m *message) {
-	user, ok := h.users[m.Username]
+// replyParent looks up the message m is replying to, and moves m into the
+// parent's channel and thread. If m can't be sent as a reply, the sender is
+// told why and nil is returned.
+func (h *hub) replyParent(m *Message) *Message {
+	user, ok := h.sender(m)
 	if !ok {
+		return nil
+	}
+	id := strconv.FormatUint(m.ReplyTo, 10)
+	parent, err := h.store.Message(m.ReplyTo)
+	if err != nil || parent.MessageType != text || parent.Deleted {
+		user.conn.write(newMessage("you", "server", "There's no message #"+id+" to reply to.\n", text))
+		return nil
+	}
+	ch, ok := h.channels[parent.Channel]
+	if !ok || !h.canPost(user, ch) {
+		user.conn.write(newMessage("you", "server", "Message #"+id+" is in "+parent.Channel+". Join it to reply.\n", text))
+		return nil
+	}
+	m.Channel = parent.Channel
+	if parent.ReplyTo > 0 {
+		m.ReplyTo = parent.ReplyTo
+	}
+	return parent
+}
+
+// canPost reports whether u can post to ch. Connected users can only post to
+// channels they're in, and API sessions to the ones they can read.
+func (h *hub) canPost(u *User, ch *channel) bool {
+	if u.credential != nil {
+		return ch.readableBy(u)
+	}
+	return ch.users[u]
+}
+
+// notifyReply lets the author of parent know that someone has replied to
+// them, in case they aren't following the channel.
+func (h *hub) notifyReply(m, parent *Message) {
+	if parent.Username == m.Username {
 		return
 	}
-	if _, ok := h.users[m.Channel]; !ok {
-		m.MessageType = text
-		m.Text = "The user " + m.Channel + " doesn't exist.\n"
-		user.conn.write(m)
+	author, ok := h.users[parent.Username]
+	// People who don't want to be disturbed can catch up on threads later.
+	if !ok || h.ignores.ignoring(author.name, m.Username) || author.presence == presenceDND {
 		return
 	}
-	user.conn.write(m)
+	author.conn.write(newMessage("you", "server", m.Username+" replied to your message #"+strconv.FormatUint(parent.ID, 10)+" in "+m.Channel+": "+strings.TrimRight(m.Text, "\n")+"\n", text))
 }
 
-func (h *hub) unmute(m *message) {
-	user, ok := h.users[m.Username]
+// record gives m an ID and the next sequence number in its log, then saves
+// it in the hub's message store.
+func (h *hub) record(m *Message) {
+	name := logName(m)
+	seq, ok := h.seqs[name]
+	if !ok {
+		var err error
+		seq, err = h.store.LastSeq(name)
+		if err != nil {
+			h.logger.Println("Unable to store message:", err.Error())
+			return
+		}
+	}
+	h.lastID++
+	m.ID = h.lastID
+	m.Seq = seq + 1
+	h.seqs[name] = m.Seq
+	if err := h.store.Append(m); err != nil {
+		h.logger.Println("Unable to store message:", err.Error())
+	}
+}
+
+// history sends a page of a channel's history to the user who asked for it.
+// The text of the message is the number of messages they'd like.
+func (h *hub) history(m *Message) {
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
-	if _, ok := h.users[m.Channel]; !ok {
-		m.MessageType = text
-		m.Text = "The user " + m.Channel + " doesn't exist.\n"
-		user.conn.write(m)
+	if ch, ok := h.channels[m.Channel]; !ok || !ch.readableBy(user) {
+		user.conn.write(newMessage("you", "server", "Channel "+m.Channel+" doesn't exist.\n", text))
 		return
 	}
-	user.conn.write(m)
+	limit, err := historyLimit(m.Text)
+	if err != nil {
+		user.conn.write(newMessage("you", "server", err.Error()+"\n", text))
+		return
+	}
+	var msgs []*Message
+	var next uint64
+	if m.Seq > 0 {
+		msgs, err = h.store.After(m.Channel, m.Seq, limit)
+	} else {
+		msgs, next, err = h.store.Page(m.Channel, m.Cursor, limit)
+	}
+	if err != nil {
+		h.logger.Println("Unable to read history:", err.Error())
+		user.conn.write(newMessage("you", "server", "Sorry, history for "+m.Channel+" isn't available right now.\n", text))
+		return
+	}
+	reply := newMessage(m.Channel, "server", "", history)
+	reply.History = msgs
+	reply.Cursor = next
+	user.conn.write(reply)
 }
 
-func (h *hub) dm(m *message) {
+// historyLimit parses the number of messages requested from a channel's
+// history, falling back to the default if s is empty.
+func historyLimit(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultHistoryLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, errors.New("The number of messages must be a positive number")
+	}
+	if n > maxHistoryLimit {
+		n = maxHistoryLimit
+	}
+	return n, nil
+}
+
+func (h *hub) dm(m *Message) {
 	h.logger.Printf("(%s to %s): %s", m.Username, m.Channel, m.Text)
-	sender, ok := h.users[m.Username]
+	sender, ok := h.sender(m)
 	if !ok {
 		return
 	}
+	if !h.authorize(sender, permDM) {
+		m.MessageType = text
+		m.Text = "Guests can't send direct messages.\n"
+		sender.conn.write(m)
+		return
+	}
 	recipient, ok := h.users[m.Channel]
 	if !ok {
 		m.MessageType = text
@@ -273,64 +952,474 @@ func (h *hub) dm(m *message) {
 		sender.conn.write(m)
 		return
 	}
+	if h.ignores.blocking(recipient.name, sender.name) {
+		sender.conn.write(newMessage("you", "server", recipient.name+" isn't accepting direct messages from you.\n", text))
+		return
+	}
+	h.stopTyping(sender, "@"+recipient.name)
+	h.record(m)
 	recipient.conn.write(m)
 	sender.conn.write(m)
+	h.awayReply(sender, recipient)
+}
+
+// edit replaces the text of a message in a channel's history, and lets
+// everyone in the channel know so they can update it too.
+func (h *hub) edit(m *Message) {
+	user, target, ok := h.modifiable(m)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(m.Text) == "" {
+		user.conn.write(newMessage("you", "server", "You can't edit a message to be blank. Try /delete instead.\n", text))
+		return
+	}
+	h.modify(m, target)
+}
+
+// remove deletes a message from a channel's history. The message keeps its
+// place, so there's no gap in the sequence numbers, but its text is gone.
+func (h *hub) remove(m *Message) {
+	_, target, ok := h.modifiable(m)
+	if !ok {
+		return
+	}
+	m.Text = ""
+	h.modify(m, target)
+}
+
+// modifiable looks up the message targeted by an edit or remove, and checks
+// that the sender is allowed to change it. If they aren't, they're told why.
+func (h *hub) modifiable(m *Message) (*User, *Message, bool) {
+	user, ok := h.sender(m)
+	if !ok {
+		return nil, nil, false
+	}
+	target, ok := h.target(user, m.Target)
+	if !ok {
+		return nil, nil, false
+	}
+	if !h.canModify(user, target, m.MessageType) {
+		user.conn.write(newMessage("you", "server", "You can only change your own messages.\n", text))
+		return nil, nil, false
+	}
+	return user, target, true
+}
+
+// target looks up the channel message with the given ID, telling u if it
+// doesn't exist or has been deleted.
+func (h *hub) target(u *User, id uint64) (*Message, bool) {
+	target, err := h.store.Message(id)
+	if err != nil || target.MessageType != text || !h.canRead(u, target.Channel) {
+		u.conn.write(newMessage("you", "server", "There's no message #"+strconv.FormatUint(id, 10)+" in any channel.\n", text))
+		return nil, false
+	}
+	if target.Deleted {
+		u.conn.write(newMessage("you", "server", "Message #"+strconv.FormatUint(id, 10)+" has been deleted.\n", text))
+		return nil, false
+	}
+	return target, true
+}
+
+// canRead reports whether u can read messages sent to the named channel.
+func (h *hub) canRead(u *User, name string) bool {
+	ch, ok := h.channels[name]
+	return ok && ch.readableBy(u)
 }
 
-func (h *hub) quit(m *message) {
+// canModify reports whether u may make a change of type t to m. Authors can
+// edit and delete their own messages, and a channel's operators can delete
+// anything sent to it.
+func (h *hub) canModify(u *User, m *Message, t MessageType) bool {
+	if u.wrote(m) {
+		return true
+	}
+	if t != remove {
+		return false
+	}
+	if h.authorize(u, permModerate) {
+		return true
+	}
+	ch, ok := h.channels[m.Channel]
+	return ok && ch.isOperator(u.id())
+}
+
+// modify saves an edit or remove of target, and sends it on to everyone in
+// the target's channel.
+func (h *hub) modify(m, target *Message) {
+	m.Channel = target.Channel
+	m.Time = time.Now()
+	if err := h.store.Append(m); err != nil {
+		h.logger.Println("Unable to store message:", err.Error())
+		return
+	}
+	h.logger.Printf("(%s changed #%d in %s): %s", m.Username, m.Target, m.Channel, m.Text)
+	if ch, ok := h.channels[m.Channel]; ok {
+		ch.broadcast(m)
+	}
+}
+
+// react adds or removes the sender's reaction to a message, and sends
+// everyone in the channel the message's updated reactions.
+func (h *hub) react(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	m.Text = strings.TrimSpace(m.Text)
+	if !validReaction(m.Text) {
+		user.conn.write(newMessage("you", "server", "Reactions must be a single word of up to "+strconv.Itoa(maxReactionLength)+" characters, like :+1:.\n", text))
+		return
+	}
+	target, ok := h.target(user, m.Target)
+	if !ok {
+		return
+	}
+	reacted := false
+	for _, name := range target.Reactions[m.Text] {
+		if name == user.name {
+			reacted = true
+			break
+		}
+	}
+	if m.MessageType == react && reacted {
+		user.conn.write(newMessage("you", "server", "You've already reacted "+m.Text+" to #"+strconv.FormatUint(target.ID, 10)+".\n", text))
+		return
+	}
+	if m.MessageType == unreact && !reacted {
+		user.conn.write(newMessage("you", "server", "You haven't reacted "+m.Text+" to #"+strconv.FormatUint(target.ID, 10)+".\n", text))
+		return
+	}
+
+	m.Channel = target.Channel
+	m.Time = time.Now()
+	if err := h.store.Append(m); err != nil {
+		h.logger.Println("Unable to store message:", err.Error())
+		return
+	}
+	if updated, err := h.store.Message(target.ID); err == nil {
+		m.Reactions = updated.Reactions
+	}
+	if ch, ok := h.channels[m.Channel]; ok {
+		ch.broadcast(m)
+	}
+}
+
+// validReaction reports whether s can be used as a reaction. Reactions are
+// meant to be short, like an emoji name, so they're limited to one word.
+func validReaction(s string) bool {
+	return s != "" && len(s) <= maxReactionLength && !strings.ContainsAny(s, " \t\r\n")
+}
+
+// topic shows the sender the topic of a channel, or changes it if the message
+// has any text.
+func (h *hub) topic(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	ch, ok := h.channels[m.Channel]
+	if !ok || !h.canPost(user, ch) {
+		user.conn.write(newMessage("you", "server", "You're not a member of the channel "+m.Channel+".\n", text))
+		return
+	}
+	t := strings.TrimSpace(m.Text)
+	if t == "" {
+		user.conn.write(ch.topicMessage())
+		return
+	}
+	if !h.isOperator(user, ch) {
+		user.conn.write(newMessage("you", "server", "Only operators can change the topic of "+ch.name+".\n", text))
+		return
+	}
+	if len(t) > maxTopicLength {
+		user.conn.write(newMessage("you", "server", "Topics can't be longer than "+strconv.Itoa(maxTopicLength)+" characters.\n", text))
+		return
+	}
+	ch.setTopic(t, user.name)
+	h.saveChannels()
+	h.logger.Printf("(%s set the topic of %s): %s", user.name, ch.name, t)
+	ch.broadcast(ch.topicMessage())
+}
+
+// channelInfo returns a description of every channel, sorted by name.
+func (h *hub) channelInfo() []*channelInfo {
+	var infos []*channelInfo
+	h.do(func() {
+		for _, ch := range h.channels {
+			if ch.mode == modeInvite {
+				continue
+			}
+			infos = append(infos, ch.info())
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// isPublic reports whether the named channel exists and anyone can read it.
+func (h *hub) isPublic(name string) bool {
+	public := false
+	h.do(func() {
+		ch, ok := h.channels[name]
+		public = ok && ch.mode == modePublic
+	})
+	return public
+}
+
+// channelExists reports whether there's a channel with the given name.
+func (h *hub) channelExists(name string) bool {
+	exists := false
+	h.do(func() {
+		_, exists = h.channels[name]
+	})
+	return exists
+}
+
+// do runs fn on the hub's goroutine and waits for it to finish. It's how
+// anything outside the hub, like the HTTP handlers, can safely read its
+// state.
+func (h *hub) do(fn func()) {
+	done := make(chan struct{})
+	h.funcCh <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+func (h *hub) quit(m *Message) {
 	h.logger.Printf("(%s to %s): %s", m.Username, m.Channel, m.Text)
-	user, ok := h.users[m.Username]
+	user, ok := h.sender(m)
 	if !ok {
 		return
 	}
 	user.conn.close()
-	delete(h.users, m.Username)
+	h.removeUser(user)
 	h.channels[defaultChannelName].broadcast(m)
 }
 
+// removeUser takes u out of the hub and every channel they're in. Guests
+// lose their standing in channels, and their mutes and blocks, too.
+func (h *hub) removeUser(u *User) {
+	if h.users[u.name] == u {
+		delete(h.users, u.name)
+	}
+	// An API session shares its name with anybody connected under it, who
+	// keeps their standing.
+	_, named := h.users[u.name]
+	forgot := false
+	for _, ch := range h.channels {
+		ch.leave(u)
+		if u.account == "" && !named && ch.forget(u.id()) {
+			forgot = true
+		}
+	}
+	if forgot {
+		h.saveChannels()
+	}
+	if u.account == "" && !named && h.ignores.forget(u.name) {
+		if err := h.ignores.save(); err != nil {
+			h.logger.Println("Unable to save mutes:", err.Error())
+		}
+	}
+}
+
 func (h *hub) run() {
-	h.channels[defaultChannelName] = newChannel(defaultChannelName, h.users)
+	if _, ok := h.channels[defaultChannelName]; !ok {
+		h.channels[defaultChannelName] = h.newChannel(defaultChannelName)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case now := <-ticker.C:
+			h.expireTyping(now)
+			if err := h.markers.save(); err != nil {
+				h.logger.Println("Unable to save read markers:", err.Error())
+			}
+
 		case user := <-h.userCh:
 			// bug: if a user joins and then quits and re-joins with that same
 			// name, you get a write to closed error
 			h.newUser(user)
 
+		case fn := <-h.funcCh:
+			fn()
+
 		case message := <-h.messageCh:
-			switch message.MessageType {
+			h.receive(message)
+		}
+	}
+}
 
-			case join:
-				h.joinChannel(message)
+// receive handles a message sent to the hub by a transport.
+func (h *hub) receive(m *Message) {
+	m.clearServerFields()
+	if !h.checkSender(m) || !h.allow(m) {
+		return
+	}
+	h.touch(m)
+	// Passwords are kept away from middleware, so they can't end up in
+	// anybody's logs.
+	if m.MessageType == register {
+		h.register(m)
+		return
+	}
+	if inlinePassword(m) {
+		replier{h, m.Username, m.session}.Reply("Passwords can't be typed after /register, where they could be seen. Type /register on its own instead.\n")
+		return
+	}
+	h.handler.ServeMessage(replier{h, m.Username, m.session}, m)
+}
 
-			case listUsers:
-				h.listUsers(message)
+// checkSender makes sure m comes from who it says it does. A message without
+// a Username is from whoever sent it, and one claiming to be from anybody
+// else is refused.
+func (h *hub) checkSender(m *Message) bool {
+	if m.from == "" {
+		h.logger.Printf("(dropped a %s message from %s without a sender)", m.MessageType, m.Username)
+		return false
+	}
+	if m.Username == "" {
+		m.Username = m.from
+	}
+	// Anything the user's connection sent before it heard about a name
+	// change is from their new name.
+	if _, ok := h.users[m.from]; !ok && m.session == nil {
+		if r, ok := h.reserved[m.from]; ok && m.Username == m.from && h.users[r.user.name] == r.user {
+			m.Username, m.from = r.user.name, r.user.name
+		}
+	}
+	if m.Username == m.from {
+		return true
+	}
+	h.logger.Printf("(%s tried to send a %s message as %s)", m.from, m.MessageType, m.Username)
+	if user, ok := h.users[m.from]; ok {
+		user.conn.write(newMessage("you", "server", "You can only send messages as yourself.\n", text))
+	}
+	return false
+}
 
-			case listChannels:
-				h.listChannels(message)
+// sender returns the user who sent m. That's its API session, if it has one,
+// and otherwise whoever's connected with its Username.
+func (h *hub) sender(m *Message) (*User, bool) {
+	if m.session != nil {
+		return m.session, true
+	}
+	user, ok := h.users[m.Username]
+	return user, ok
+}
 
-			case create:
-				h.createChannel(message)
+// dispatch is the last handler in the chain, and does whatever a message
+// asks of the hub.
+func (h *hub) dispatch(r Replier, message *Message) {
+	switch message.MessageType {
 
-			case leave:
-				h.leaveChannel(message)
+	case join:
+		h.joinChannel(message)
 
-			case text:
-				h.broadcast(message)
+	case listUsers:
+		h.listUsers(message)
 
-			case mute:
-				h.mute(message)
+	case listChannels:
+		h.listChannels(message)
 
-			case unmute:
-				h.unmute(message)
+	case create:
+		h.createChannel(message)
 
-			case dm:
-				h.dm(message)
+	case leave:
+		h.leaveChannel(message)
 
-			case quit:
-				h.quit(message)
-			}
-		}
+	case text:
+		h.broadcast(message)
+
+	case mute, unmute, block, unblock:
+		h.ignore(message)
+
+	case listMutes:
+		h.listIgnores(message)
+
+	case dm:
+		h.dm(message)
+
+	case quit:
+		h.quit(message)
+
+	case history:
+		h.history(message)
+
+	case edit:
+		h.edit(message)
+
+	case remove:
+		h.remove(message)
+
+	case react, unreact:
+		h.react(message)
+
+	case topic:
+		h.topic(message)
+
+	case op, deop:
+		h.setOperator(message)
+
+	case kick:
+		h.kick(message)
+
+	case mode:
+		h.setMode(message)
+
+	case invite:
+		h.invite(message)
+
+	case ban:
+		h.ban(message)
+
+	case unban:
+		h.unban(message)
+
+	case listBans:
+		h.listBans(message)
+
+	case slowmode:
+		h.setSlowmode(message)
+
+	case command:
+		h.command(r, message)
+
+	case reload:
+		h.reload(message)
+
+	case token:
+		h.issueToken(message)
+
+	case listTokens:
+		h.listTokens(message)
+
+	case revokeToken:
+		h.revokeToken(message)
+
+	case nick:
+		h.nick(message)
+
+	case whowas:
+		h.whowas(message)
+
+	case away, dnd, back:
+		h.setPresence(message)
+
+	case whois:
+		h.whois(message)
+
+	case typing:
+		h.typing(message)
+
+	case markRead:
+		h.markRead(message)
+
+	case unread:
+		h.unread(message)
 	}
 }
 
@@ -340,20 +1429,7 @@ func (h *hub) serve(port string) error {
 		return err
 	}
 	h.logger.Println("Server started on", port)
-
-	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				h.logger.Println(err.Error())
-			}
-			go func() {
-				h.userCh <- createTCPUser(conn, h)
-			}()
-		}
-	}()
-
-	h.run()
+	h.accept(server)
 	return nil
 }
 
@@ -364,21 +1440,32 @@ func (h *hub) serveSecure(port string) error {
 		return err
 	}
 	h.logger.Println("Secure server started on", port)
+	h.accept(server)
+	return nil
+}
 
-	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				h.logger.Println(err.Error())
-			}
-			go func() {
-				h.userCh <- createTCPUser(conn, h)
-			}()
+// accept hands each connection made to the listener to the hub as a new
+// user.
+func (h *hub) accept(server net.Listener) {
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			h.logger.Println(err.Error())
+			continue
 		}
-	}()
-
-	h.run()
-	return nil
+		if b := h.bans.addrBanned(conn.RemoteAddr().String()); b != nil {
+			h.logger.Println("Refused connection from", conn.RemoteAddr().String()+":", b.describe())
+			conn.Write([]byte("You're banned from this server.\n"))
+			conn.Close()
+			continue
+		}
+		go func() {
+			// Users who hang up before choosing a name never join.
+			if u := createTCPUser(conn, h); u != nil {
+				h.userCh <- u
+			}
+		}()
+	}
 }
 
 func (h *hub) serveHTTP(port string, mux http.Handler) error {
@@ -397,18 +1484,24 @@ func (h *hub) serveHTTPS(port string, mux http.Handler) error {
 }
 
 // ListenAndServe starts the TCP and HTTP servers based on the given config.
-func ListenAndServe(l *log.Logger, cfg *Config) error {
-	h := newHub(l)
+func ListenAndServe(l *log.Logger, cfg *Config, mws ...Middleware) error {
+	h, err := openHub(l, cfg, mws...)
+	if err != nil {
+		return err
+	}
 	errCh := make(chan error, 4)
 	mux := getServeMux(h)
 
+	// There's only ever one run loop, since it's what makes sure messages
+	// are numbered in the order they're sent.
+	go h.run()
 	go h.serveHTTP(":"+cfg.HTTPPortAddr, mux)
 	go h.serveHTTPS(":"+cfg.HTTPSPortAddr, mux)
 	go h.serve(":" + cfg.TCPPortAddr)
 	go h.serveSecure(":" + cfg.TCPSPortAddr)
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
@@ -417,8 +1510,72 @@ func ListenAndServe(l *log.Logger, cfg *Config) error {
 				h.logger.Fatalf("%s\n", err.Error())
 			}
 		case s := <-signalCh:
+			if s == syscall.SIGHUP {
+				h.do(func() {
+					if err := h.reloadFilters(); err != nil {
+						h.logger.Println("Unable to reload filters:", err.Error())
+					}
+				})
+				continue
+			}
 			log.Printf("Captured %v. Exiting...\n", s)
+			h.store.Close()
 			os.Exit(1)
 		}
 	}
 }
+
+// openHub creates a hub for the given config, with everything it keeps on
+// disk loaded, but without starting its run loop.
+func openHub(l *log.Logger, cfg *Config, mws ...Middleware) (*hub, error) {
+	if _, err := parseRole(cfg.DefaultRole); err != nil {
+		return nil, err
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h := newHub(l, cfg, store, mws...)
+	if h.lastID, err = store.LastID(); err != nil {
+		return nil, err
+	}
+	if h.bans, err = newBanList(dataPath(cfg, "bans.json")); err != nil {
+		return nil, err
+	}
+	reserved := append(append([]string{}, cfg.Admins...), cfg.Moderators...)
+	if h.accounts, err = newAccountStore(dataPath(cfg, "accounts.json"), reserved); err != nil {
+		return nil, err
+	}
+	h.channelsPath = dataPath(cfg, "channels.json")
+	if err := h.restoreChannels(); err != nil {
+		return nil, err
+	}
+	if h.tokens, err = newTokenStore(dataPath(cfg, "tokens.json")); err != nil {
+		return nil, err
+	}
+	if h.ignores, err = newIgnoreList(dataPath(cfg, "mutes.json")); err != nil {
+		return nil, err
+	}
+	h.ignores.forgetGuests(h.accounts.exists)
+	if h.names, err = newNameHistory(dataPath(cfg, "names.json")); err != nil {
+		return nil, err
+	}
+	if h.markers, err = newReadMarkers(dataPath(cfg, "markers.json")); err != nil {
+		return nil, err
+	}
+	if h.limiter, err = newLimiter(&cfg.Flood); err != nil {
+		return nil, err
+	}
+	if h.filters, err = newFilters(cfg.Filters); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// openStore returns the message store described by cfg.
+func openStore(cfg *Config) (MessageStore, error) {
+	if cfg.DataDir == "" {
+		return newMemoryStore(), nil
+	}
+	return newFileStore(filepath.Join(cfg.DataDir, "history"))
+}
@@ -0,0 +1,358 @@
+package chat
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testConn is a connection that keeps everything written to it.
+type testConn struct {
+	mu      sync.Mutex
+	written []*Message
+	closed  bool
+}
+
+func (c *testConn) read() error { return nil }
+
+func (c *testConn) write(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, m)
+	return nil
+}
+
+func (c *testConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// saw reports whether anything written to the connection contains s.
+func (c *testConn) saw(s string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.written {
+		if strings.Contains(m.Text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// startHub opens a hub keeping its data in dir, and starts its run loop.
+func startHub(t *testing.T, cfg *Config, dir string, mws ...Middleware) *hub {
+	t.Helper()
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.DataDir = dir
+	h, err := openHub(log.New(io.Discard, "", 0), cfg, mws...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.run()
+	t.Cleanup(func() { h.store.Close() })
+	return h
+}
+
+// connect adds a user to the hub, logged in to account if it isn't empty.
+func connect(h *hub, name, account string) *testConn {
+	c := &testConn{}
+	h.userCh <- &User{name: name, account: account, addr: "192.0.2.1", conn: c, transport: transportTCP}
+	h.do(func() {})
+	return c
+}
+
+// post sends m to the hub from whoever it says it's from, and waits for it
+// to be handled.
+func post(h *hub, m *Message) {
+	if m.from == "" {
+		m.from = m.Username
+	}
+	h.messageCh <- m
+	h.do(func() {})
+}
+
+// run sends a command to the hub as name, from the given channel.
+func run(h *hub, name, channel, cmd string) {
+	post(h, newMessage(channel, name, cmd, command))
+}
+
+func TestGuestsLoseChannelAuthorityWhenTheyLeave(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "bob", "")
+	run(h, "bob", defaultChannelName, "/newroom den")
+	run(h, "bob", "den", "/mode invite")
+	post(h, newMessage("everyone", "bob", "bob has left that chat\n", quit))
+
+	// Somebody else picking the same name doesn't get the channel.
+	connect(h, "bob", "")
+	run(h, "bob", defaultChannelName, "/join den")
+	run(h, "bob", "den", "/mode public")
+	h.do(func() {
+		ch := h.channels["den"]
+		if ch.owner != "" || ch.mode != modeInvite {
+			t.Errorf("owner %q, mode %s, want no owner and still invite only", ch.owner, ch.mode)
+		}
+		if ch.users[h.users["bob"]] {
+			t.Error("the new bob was let in to an invite only channel")
+		}
+	})
+}
+
+func TestAccountsKeepChannelAuthority(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "alice")
+	run(h, "alice", defaultChannelName, "/newroom den")
+	run(h, "alice", "den", "/nick ally")
+	run(h, "ally", "den", "/mode invite")
+	h.do(func() {
+		ch := h.channels["den"]
+		if ch.owner != "alice" || ch.mode != modeInvite {
+			t.Errorf("owner %q, mode %s, want alice and invite only", ch.owner, ch.mode)
+		}
+	})
+}
+
+func TestChannelSettingsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	h := startHub(t, nil, dir)
+	if err := h.accounts.add("alice", "longpassword"); err != nil {
+		t.Fatal(err)
+	}
+	connect(h, "alice", "alice")
+	run(h, "alice", defaultChannelName, "/newroom vault")
+	run(h, "alice", "vault", "/mode key hunter2")
+	run(h, "alice", "vault", "/topic secrets")
+	post(h, newMessage("vault", "alice", "the launch codes\n", text))
+	h.store.Close()
+
+	h = startHub(t, nil, dir)
+	h.do(func() {
+		ch, ok := h.channels["vault"]
+		if !ok {
+			t.Error("the channel wasn't restored")
+			return
+		}
+		if ch.mode != modeKey || ch.key != "hunter2" || ch.topic != "secrets" || ch.owner != "alice" {
+			t.Errorf("got mode %s, key %q, topic %q, owner %q", ch.mode, ch.key, ch.topic, ch.owner)
+		}
+	})
+	connect(h, "eve", "")
+	run(h, "eve", defaultChannelName, "/newroom vault")
+	h.do(func() {
+		if ch := h.channels["vault"]; ch.owner == "eve" || ch.users[h.users["eve"]] {
+			t.Error("eve took over the channel")
+		}
+	})
+}
+
+func TestChannelsWithHistoryNeedAModerator(t *testing.T) {
+	h := startHub(t, &Config{Moderators: []string{"mod"}}, t.TempDir())
+	connect(h, "bob", "")
+	run(h, "bob", defaultChannelName, "/newroom old")
+	post(h, newMessage("old", "bob", "from before\n", text))
+	// Lose the channel's settings, like a server that ran before they were
+	// saved.
+	h.do(func() { delete(h.channels, "old") })
+
+	eve := connect(h, "eve", "")
+	run(h, "eve", defaultChannelName, "/newroom old")
+	if !eve.saw("only a moderator") {
+		t.Error("eve could create a channel with history")
+	}
+	connect(h, "mod", "mod")
+	run(h, "mod", defaultChannelName, "/newroom old")
+	h.do(func() {
+		if ch, ok := h.channels["old"]; !ok || ch.owner != "mod" {
+			t.Error("a moderator couldn't create a channel with history")
+		}
+	})
+}
+
+func TestServerFieldsAreCleared(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "bob", "")
+	m := newMessage(defaultChannelName, "bob", "hello\n", text)
+	m.ID = 999
+	m.Time = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.Edited, m.Deleted = true, true
+	m.Reactions = map[string][]string{":+1:": {"everyone"}}
+	m.History = []*Message{newMessage(defaultChannelName, "alice", "I never said this", text)}
+	m.Meta = map[string]string{"verified": "yes"}
+	post(h, m)
+
+	msgs, _, err := h.store.Page(defaultChannelName, 0, 1)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("got %v, %v", msgs, err)
+	}
+	got := msgs[0]
+	if got.ID == 999 || got.Edited || got.Deleted || got.Reactions != nil || got.History != nil || got.Meta != nil {
+		t.Errorf("server fields were kept: %+v", got)
+	}
+	if time.Since(got.Time) > time.Minute {
+		t.Errorf("message was backdated to %s", got.Time)
+	}
+}
+
+func TestSendersCantBeForged(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	bob := connect(h, "bob", "")
+	connect(h, "alice", "")
+	m := newMessage(defaultChannelName, "alice", "it was me\n", text)
+	m.from = "bob"
+	post(h, m)
+	if seq, _ := h.store.LastSeq(defaultChannelName); seq != 0 {
+		t.Error("bob sent a message as alice")
+	}
+	if !bob.saw("only send messages as yourself") {
+		t.Error("bob wasn't told why")
+	}
+}
+
+func TestRepliesAreFilteredByTheirThread(t *testing.T) {
+	cfg := &Config{Filters: []FilterConfig{{Words: []string{"darn"}, Action: "reject", Channels: []string{defaultChannelName}}}}
+	h := startHub(t, cfg, t.TempDir())
+	bob := connect(h, "bob", "")
+	post(h, newMessage(defaultChannelName, "bob", "hello\n", text))
+	run(h, "bob", defaultChannelName, "/newroom other")
+
+	// The reply says it's for other, but it ends up in general's thread.
+	reply := newMessage("other", "bob", "darn\n", text)
+	reply.ReplyTo = 1
+	post(h, reply)
+	if seq, _ := h.store.LastSeq(defaultChannelName); seq != 1 {
+		t.Error("the reply got past general's filter")
+	}
+	if !bob.saw("wasn't sent") {
+		t.Error("bob wasn't told the reply was rejected")
+	}
+}
+
+func TestTypingIsOnlyTrackedForRealTargets(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "bob", "")
+	for _, target := range []string{"nowhere", "@nobody"} {
+		post(h, newMessage(target, "bob", typingStarted, typing))
+	}
+	h.do(func() {
+		if len(h.typists) != 0 {
+			t.Errorf("tracked typing in %d places that don't exist", len(h.typists))
+		}
+	})
+	post(h, newMessage(defaultChannelName, "bob", typingStarted, typing))
+	h.do(func() {
+		if len(h.typists) != 1 {
+			t.Errorf("got %d typists, want 1", len(h.typists))
+		}
+	})
+}
+
+func TestTypingHasItsOwnLimit(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	bob := connect(h, "bob", "")
+	h.do(func() {
+		m := newMessage(defaultChannelName, "bob", typingStarted, typing)
+		for i := 0; i < typingLimit.Burst; i++ {
+			if !h.allow(m) {
+				t.Errorf("typing message %d was dropped", i+1)
+				return
+			}
+		}
+		if h.allow(m) {
+			t.Error("typing wasn't limited")
+		}
+		// Typing too much isn't flooding, and doesn't stop anything else.
+		if !h.allow(newMessage(defaultChannelName, "bob", "hello\n", text)) {
+			t.Error("typing used up the limit for messages")
+		}
+	})
+	if bob.saw("too quickly") {
+		t.Error("bob was warned about typing")
+	}
+}
+
+func TestHiddenChannelsDontListTheirUsers(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "")
+	run(h, "alice", defaultChannelName, "/newroom secret")
+	run(h, "alice", "secret", "/mode invite")
+	eve := connect(h, "eve", "")
+	post(h, newMessage("secret", "eve", "", listUsers))
+	if eve.saw("alice") || !eve.saw("doesn't exist") {
+		t.Error("eve could see who's in an invite only channel")
+	}
+}
+
+func TestCreatingAHiddenChannelDoesntRevealIt(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "")
+	run(h, "alice", defaultChannelName, "/newroom secret")
+	run(h, "alice", "secret", "/mode invite")
+	eve := connect(h, "eve", "")
+	run(h, "eve", defaultChannelName, "/newroom secret")
+	if eve.saw("invite only") || !eve.saw("doesn't exist") {
+		t.Error("eve found out the channel exists")
+	}
+}
+
+func TestOnlyAuthorsCanChangeTheirMessages(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "bob", "")
+	connect(h, "alice", "alice")
+	post(h, newMessage(defaultChannelName, "bob", "from the first bob\n", text))
+	post(h, newMessage(defaultChannelName, "alice", "from alice\n", text))
+	post(h, newMessage("everyone", "bob", "bob has left that chat\n", quit))
+	post(h, newMessage("everyone", "alice", "alice has left that chat\n", quit))
+
+	// Somebody else taking bob's name doesn't make the first bob's messages
+	// theirs, but logging in to alice's account still does.
+	bob := connect(h, "bob", "")
+	run(h, "bob", defaultChannelName, "/edit 1 from the second bob")
+	if !bob.saw("only change your own") {
+		t.Error("the second bob could edit the first bob's message")
+	}
+	connect(h, "alice", "alice")
+	run(h, "alice", defaultChannelName, "/edit 2 still from alice")
+	if m, err := h.store.Message(2); err != nil || !m.Edited {
+		t.Errorf("got %+v, %v, want alice's message edited", m, err)
+	}
+}
+
+func TestNamesAreChecked(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	bob := connect(h, "bob", "")
+	for _, name := range []string{"", "bob smith", "bob\x07", "Server", strings.Repeat("b", maxNameLength+1)} {
+		post(h, newMessage(name, "bob", "", nick))
+	}
+	h.do(func() {
+		if _, ok := h.users["bob"]; !ok || len(h.users) != 1 {
+			t.Error("bob was renamed")
+		}
+	})
+	for _, problem := range []string{"blank", "spaces", "used by the server", "longer than"} {
+		if !bob.saw(problem) {
+			t.Errorf("bob wasn't told a name was %q", problem)
+		}
+	}
+}
+
+func TestGuestsDontInheritMutes(t *testing.T) {
+	h := startHub(t, nil, t.TempDir())
+	connect(h, "alice", "alice")
+	connect(h, "bob", "")
+	post(h, newMessage("alice", "bob", "", mute))
+	post(h, newMessage("bob", "alice", "", block))
+	post(h, newMessage("everyone", "bob", "bob has left that chat\n", quit))
+
+	connect(h, "bob", "")
+	h.do(func() {
+		if h.ignores.ignoring("bob", "alice") || h.ignores.blocking("alice", "bob") {
+			t.Error("the new bob was given the old bob's mutes and blocks")
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+)
+
+// ignores are the users someone has muted or blocked. Messages from muted
+// users aren't delivered to them, and blocked users are muted, but also
+// can't send them direct messages.
+type ignores struct {
+	Muted   []string `json:",omitempty"`
+	Blocked []string `json:",omitempty"`
+}
+
+// An ignoreList holds everyone's mutes and blocks, keyed by user name, and
+// saves them to disk whenever they change. It's only used by the hub's run
+// loop.
+type ignoreList struct {
+	path    string
+	muted   map[string]map[string]bool
+	blocked map[string]map[string]bool
+}
+
+func newIgnoreList(path string) (*ignoreList, error) {
+	l := &ignoreList{
+		path:    path,
+		muted:   make(map[string]map[string]bool),
+		blocked: make(map[string]map[string]bool),
+	}
+	saved := make(map[string]*ignores)
+	if err := loadJSON(path, &saved); err != nil {
+		return nil, err
+	}
+	for name, ig := range saved {
+		for _, target := range ig.Muted {
+			addIgnore(l.muted, name, target)
+		}
+		for _, target := range ig.Blocked {
+			addIgnore(l.blocked, name, target)
+		}
+	}
+	return l, nil
+}
+
+// addIgnore adds target to the set kept for name, reporting whether it's
+// new.
+func addIgnore(sets map[string]map[string]bool, name, target string) bool {
+	set, ok := sets[name]
+	if !ok {
+		set = make(map[string]bool)
+		sets[name] = set
+	}
+	if set[target] {
+		return false
+	}
+	set[target] = true
+	return true
+}
+
+// removeIgnore removes target from the set kept for name, reporting whether
+// it was there.
+func removeIgnore(sets map[string]map[string]bool, name, target string) bool {
+	set := sets[name]
+	if !set[target] {
+		return false
+	}
+	delete(set, target)
+	if len(set) == 0 {
+		delete(sets, name)
+	}
+	return true
+}
+
+// ignoring reports whether name doesn't want to see messages from sender.
+func (l *ignoreList) ignoring(name, sender string) bool {
+	return l.muted[name][sender] || l.blocked[name][sender]
+}
+
+// blocking reports whether name has blocked sender.
+func (l *ignoreList) blocking(name, sender string) bool {
+	return l.blocked[name][sender]
+}
+
+// forget drops the mutes and blocks of the named user, and everyone's mutes
+// and blocks of them, reporting whether there were any. It's used when
+// guests leave, so whoever picks their name next starts afresh.
+func (l *ignoreList) forget(name string) bool {
+	changed := false
+	for _, sets := range []map[string]map[string]bool{l.muted, l.blocked} {
+		if _, ok := sets[name]; ok {
+			delete(sets, name)
+			changed = true
+		}
+		for other := range sets {
+			if removeIgnore(sets, other, name) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// forgetGuests forgets everyone isAccount reports false for, which is what's
+// left of guests who were around when the server last stopped.
+func (l *ignoreList) forgetGuests(isAccount func(name string) bool) {
+	for _, sets := range []map[string]map[string]bool{l.muted, l.blocked} {
+		for name, set := range sets {
+			if !isAccount(name) {
+				l.forget(name)
+			}
+			for target := range set {
+				if !isAccount(target) {
+					l.forget(target)
+				}
+			}
+		}
+	}
+}
+
+func (l *ignoreList) save() error {
+	saved := make(map[string]*ignores)
+	for name, set := range l.muted {
+		saved[name] = &ignores{Muted: sortedKeys(set)}
+	}
+	for name, set := range l.blocked {
+		ig, ok := saved[name]
+		if !ok {
+			ig = &ignores{}
+			saved[name] = ig
+		}
+		ig.Blocked = sortedKeys(set)
+	}
+	return saveJSON(l.path, saved)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// An ignoringConn drops messages from the users its owner is ignoring before
+// they're written to the connection, so mutes work the same way whatever
+// transport someone is connected with.
+type ignoringConn struct {
+	connection
+	h *hub
+	u *User
+}
+
+func (c *ignoringConn) write(m *Message) error {
+	if c.h.ignores.ignoring(c.u.name, m.Username) {
+		return nil
+	}
+	if len(m.History) > 0 {
+		var history []*Message
+		for _, hm := range m.History {
+			if !c.h.ignores.ignoring(c.u.name, hm.Username) {
+				history = append(history, hm)
+			}
+		}
+		if len(history) < len(m.History) {
+			cp := *m
+			cp.History = history
+			m = &cp
+		}
+	}
+	return c.connection.write(m)
+}
+
+// ignore mutes or blocks a user, or unmutes or unblocks them, depending on
+// the type of the message. The channel of the message is the name of the
+// user.
+func (h *hub) ignore(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	name := m.Channel
+	var changed bool
+	switch m.MessageType {
+	case mute, block:
+		if name == user.name {
+			user.conn.write(newMessage("you", "server", "You can't "+m.MessageType.String()+" yourself.\n", text))
+			return
+		}
+		if _, ok := h.users[name]; !ok {
+			user.conn.write(newMessage("you", "server", "The user "+name+" doesn't exist.\n", text))
+			return
+		}
+		if m.MessageType == mute {
+			changed = addIgnore(h.ignores.muted, user.name, name)
+		} else {
+			changed = addIgnore(h.ignores.blocked, user.name, name)
+		}
+	case unmute:
+		changed = removeIgnore(h.ignores.muted, user.name, name)
+	case unblock:
+		changed = removeIgnore(h.ignores.blocked, user.name, name)
+	}
+
+	if !changed {
+		switch m.MessageType {
+		case mute:
+			user.conn.write(newMessage("you", "server", "User "+name+" is already muted.\n", text))
+		case block:
+			user.conn.write(newMessage("you", "server", "User "+name+" is already blocked.\n", text))
+		case unmute:
+			user.conn.write(newMessage("you", "server", "User "+name+" isn't muted.\n", text))
+		case unblock:
+			user.conn.write(newMessage("you", "server", "User "+name+" isn't blocked.\n", text))
+		}
+		return
+	}
+	if err := h.ignores.save(); err != nil {
+		h.logger.Println("Unable to save mutes:", err.Error())
+	}
+	user.conn.write(m)
+}
+
+// listIgnores tells a user who they've muted and blocked.
+func (h *hub) listIgnores(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	var lines []string
+	if muted := h.ignores.muted[user.name]; len(muted) > 0 {
+		lines = append(lines, "You've muted:\n  - "+strings.Join(sortedKeys(muted), "\n  - "))
+	}
+	if blocked := h.ignores.blocked[user.name]; len(blocked) > 0 {
+		lines = append(lines, "You've blocked:\n  - "+strings.Join(sortedKeys(blocked), "\n  - "))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "You haven't muted or blocked anyone.")
+	}
+	user.conn.write(newMessage("you", user.name, strings.Join(lines, "\n"), listMutes))
+}
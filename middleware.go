@@ -0,0 +1,58 @@
+package chat
+
+// A Handler responds to a message sent to the hub.
+//
+// ServeMessage is called from the hub's run loop, one message at a time, so
+// it must not block. The Replier is only valid until ServeMessage returns.
+type Handler interface {
+	ServeMessage(r Replier, m *Message)
+}
+
+// A HandlerFunc is an ordinary function used as a Handler.
+type HandlerFunc func(r Replier, m *Message)
+
+// ServeMessage calls f(r, m).
+func (f HandlerFunc) ServeMessage(r Replier, m *Message) {
+	f(r, m)
+}
+
+// A Middleware wraps the next Handler in the chain. It can inspect or rewrite
+// a message before passing it on, annotate it by setting its Meta, answer it
+// itself, or drop it by not calling next at all. Messages reach middleware
+// after flood limits have been applied, and before the hub acts on them.
+type Middleware func(next Handler) Handler
+
+// A Replier sends server notices back to whoever sent a message.
+type Replier interface {
+	// Reply sends text to the sender of the message, if they're still
+	// connected.
+	Reply(text string)
+}
+
+// chain wraps h in each middleware, so the first one is the first to see
+// each message.
+func chain(h Handler, mws []Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// A replier replies to the sender of a message on behalf of the hub. Replies
+// to a message sent through the API go to its session.
+type replier struct {
+	h        *hub
+	username string
+	session  *User
+}
+
+func (r replier) Reply(s string) {
+	user, ok := r.h.users[r.username]
+	if r.session != nil {
+		user, ok = r.session, true
+	}
+	if !ok {
+		return
+	}
+	user.conn.write(newMessage("you", "server", s, text))
+}
@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSlowmode is the most seconds slow mode can make users wait between
+// posts.
+const maxSlowmode = 6 * 60 * 60
+
+// operatorChannel returns the sender of m and the channel it was sent to,
+// as long as the sender is one of that channel's operators or a moderator.
+// Otherwise the sender is told why not.
+func (h *hub) operatorChannel(m *Message) (*User, *channel, bool) {
+	user, ok := h.sender(m)
+	if !ok {
+		return nil, nil, false
+	}
+	ch, ok := h.channels[m.Channel]
+	if !ok {
+		user.conn.write(newMessage("you", "server", "The channel "+m.Channel+" doesn't exist.\n", text))
+		return nil, nil, false
+	}
+	if !h.isOperator(user, ch) {
+		user.conn.write(newMessage("you", "server", "You need to be an operator of "+ch.name+" to do that.\n", text))
+		return nil, nil, false
+	}
+	return user, ch, true
+}
+
+// setOperator gives or takes away operator status in a channel. The text of
+// the message is the name of the user. The channel's owner is always an
+// operator, so they can't be removed.
+func (h *hub) setOperator(m *Message) {
+	user, ch, ok := h.operatorChannel(m)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(m.Text)
+	target, ok := h.users[name]
+	if !ok || !ch.users[target] {
+		user.conn.write(newMessage("you", "server", "The user "+name+" isn't in "+ch.name+".\n", text))
+		return
+	}
+
+	if m.MessageType == op {
+		if ch.isOperator(target.id()) {
+			user.conn.write(newMessage("you", "server", name+" is already an operator of "+ch.name+".\n", text))
+			return
+		}
+		ch.ops[target.id()] = true
+		h.saveChannels()
+		h.logger.Printf("(%s made %s an operator of %s)", user.name, name, ch.name)
+		ch.broadcast(newMessage(ch.name, "server", user.name+" made "+name+" an operator of "+ch.name+".\n", text))
+		return
+	}
+
+	if target.id() == ch.owner {
+		user.conn.write(newMessage("you", "server", name+" owns "+ch.name+", so they're always an operator.\n", text))
+		return
+	}
+	if !ch.ops[target.id()] {
+		user.conn.write(newMessage("you", "server", name+" isn't an operator of "+ch.name+".\n", text))
+		return
+	}
+	delete(ch.ops, target.id())
+	h.saveChannels()
+	h.logger.Printf("(%s removed %s as an operator of %s)", user.name, name, ch.name)
+	ch.broadcast(newMessage(ch.name, "server", user.name+" removed "+name+" as an operator of "+ch.name+".\n", text))
+}
+
+// kick removes a user from a channel and sends them back to the default
+// channel. The text of the message is the name of the user, optionally
+// followed by the reason they're being kicked.
+func (h *hub) kick(m *Message) {
+	user, ch, ok := h.operatorChannel(m)
+	if !ok {
+		return
+	}
+	name, reason := splitArg(m.Text)
+	target, ok := h.users[name]
+	if !ok || !ch.users[target] {
+		user.conn.write(newMessage("you", "server", "The user "+name+" isn't in "+ch.name+".\n", text))
+		return
+	}
+	if !h.canKick(user, target, ch) {
+		user.conn.write(newMessage("you", "server", "You can't kick "+name+" from "+ch.name+".\n", text))
+		return
+	}
+
+	// Everyone is always in the default channel, so being kicked out of it
+	// means being kicked off the server, which only moderators can do.
+	if ch.name == defaultChannelName {
+		if !h.authorize(user, permModerate) {
+			user.conn.write(newMessage("you", "server", "Only moderators can kick people from "+ch.name+".\n", text))
+			return
+		}
+		h.logger.Printf("(%s kicked %s from the server): %s", user.name, name, reason)
+		h.disconnect(target, "You've been kicked from the server by "+user.name, reason)
+		return
+	}
+
+	notice := user.name + " kicked " + name + " from " + ch.name
+	if reason != "" {
+		notice += " (" + reason + ")"
+	}
+	h.logger.Printf("(%s)", notice)
+	ch.leave(target)
+	if ch.invited[target.id()] {
+		delete(ch.invited, target.id())
+		h.saveChannels()
+	}
+	target.conn.write(newMessage(ch.name, "server", notice+". Returning you to the "+defaultChannelName+" channel.\n", leave))
+	ch.broadcast(newMessage(ch.name, "server", notice+".\n", text))
+}
+
+// canKick reports whether u can kick target from ch. Moderators can kick
+// anyone with a lower role. Otherwise, only the owner can kick other
+// operators, and nobody can kick the owner.
+func (h *hub) canKick(u, target *User, ch *channel) bool {
+	if target.role >= roleModerator && target.role >= u.role {
+		return false
+	}
+	if h.authorize(u, permModerate) {
+		return true
+	}
+	if target.id() == ch.owner {
+		return false
+	}
+	return !ch.ops[target.id()] || u.id() == ch.owner
+}
+
+// setMode changes who can join a channel. The text of the message is the new
+// mode, followed by the key if the mode is "key".
+func (h *hub) setMode(m *Message) {
+	user, ch, ok := h.operatorChannel(m)
+	if !ok {
+		return
+	}
+	if ch.name == defaultChannelName {
+		user.conn.write(newMessage("you", "server", "Everyone can always join "+defaultChannelName+".\n", text))
+		return
+	}
+	name, key := splitArg(m.Text)
+	switch name {
+	case "public":
+		ch.mode, ch.key = modePublic, ""
+	case "invite":
+		ch.mode, ch.key = modeInvite, ""
+	case "key":
+		if key == "" || strings.ContainsAny(key, " \t") {
+			user.conn.write(newMessage("you", "server", "A channel's key must be a single word.\n", text))
+			return
+		}
+		ch.mode, ch.key = modeKey, key
+	default:
+		user.conn.write(newMessage("you", "server", "Channels can be public, invite or key.\n", text))
+		return
+	}
+	h.saveChannels()
+	h.logger.Printf("(%s set the mode of %s to %s)", user.name, ch.name, ch.mode)
+	ch.broadcast(newMessage(ch.name, "server", user.name+" set the mode of "+ch.name+" to "+ch.mode.String()+".\n", text))
+}
+
+// setSlowmode sets how long users have to wait between posts in a channel.
+// The text of the message is the number of seconds, and zero turns slow mode
+// off. Operators aren't slowed down.
+func (h *hub) setSlowmode(m *Message) {
+	user, ch, ok := h.operatorChannel(m)
+	if !ok {
+		return
+	}
+	secs, err := strconv.Atoi(strings.TrimSpace(m.Text))
+	if err != nil || secs < 0 || secs > maxSlowmode {
+		user.conn.write(newMessage("you", "server", "Slow mode must be a number of seconds, up to "+strconv.Itoa(maxSlowmode)+".\n", text))
+		return
+	}
+	ch.slowmode = time.Duration(secs) * time.Second
+	ch.lastPost = make(map[string]time.Time)
+	h.saveChannels()
+	h.logger.Printf("(%s set slow mode in %s to %ds)", user.name, ch.name, secs)
+	if secs == 0 {
+		ch.broadcast(newMessage(ch.name, "server", user.name+" turned off slow mode in "+ch.name+".\n", text))
+		return
+	}
+	ch.broadcast(newMessage(ch.name, "server", user.name+" turned on slow mode in "+ch.name+". Everyone can post once every "+ch.slowmode.String()+".\n", text))
+}
+
+// invite lets a user join a channel even if it's invite only or needs a
+// key. The text of the message is the name of the user.
+func (h *hub) invite(m *Message) {
+	user, ch, ok := h.operatorChannel(m)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(m.Text)
+	target, ok := h.users[name]
+	if !ok {
+		user.conn.write(newMessage("you", "server", "The user "+name+" doesn't exist.\n", text))
+		return
+	}
+	if ch.users[target] {
+		user.conn.write(newMessage("you", "server", name+" is already in "+ch.name+".\n", text))
+		return
+	}
+	ch.invited[target.id()] = true
+	h.saveChannels()
+	h.logger.Printf("(%s invited %s to %s)", user.name, name, ch.name)
+	user.conn.write(newMessage("you", "server", "Invited "+name+" to "+ch.name+".\n", text))
+	target.conn.write(newMessage("you", "server", user.name+" invited you to "+ch.name+". Type /join "+ch.name+" to join it.\n", text))
+}
+
+// splitArg splits s into its first word and the rest of the text.
+func splitArg(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i+1:])
+}
@@ -0,0 +1,281 @@
+package chat
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// nameReservation is how long someone's old name is kept for them after they
+// change it, so nobody else can pick it up and pretend to be them.
+const nameReservation = 5 * time.Minute
+
+// maxNameLength is the longest name anybody can use.
+const maxNameLength = 32
+
+// serverNames are the names the server sends messages as, or to, so nobody
+// can be mistaken for it.
+var serverNames = map[string]bool{"server": true, "you": true, "everyone": true}
+
+// checkName returns why nobody can use name, if they can't.
+func checkName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("Names can't be blank.")
+	case strings.HasPrefix(name, "@"):
+		return errors.New("Names can't start with @.")
+	case len(name) > maxNameLength:
+		return errors.New("Names can't be longer than " + strconv.Itoa(maxNameLength) + " characters.")
+	case strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0:
+		return errors.New("Names can't have spaces or control characters in them.")
+	case serverNames[strings.ToLower(name)]:
+		return errors.New("The name " + name + " is used by the server.")
+	}
+	return nil
+}
+
+// A nameChange records someone changing their name.
+type nameChange struct {
+	Old     string
+	New     string
+	Account string `json:",omitempty"`
+	Addr    string `json:",omitempty"`
+	Time    time.Time
+}
+
+// A nameHistory holds every name change, oldest first, and saves them to
+// disk whenever there's a new one. It's only used by the hub's run loop.
+type nameHistory struct {
+	path    string
+	changes []*nameChange
+}
+
+func newNameHistory(path string) (*nameHistory, error) {
+	nh := &nameHistory{path: path}
+	if err := loadJSON(path, &nh.changes); err != nil {
+		return nil, err
+	}
+	return nh, nil
+}
+
+func (nh *nameHistory) record(c *nameChange) error {
+	nh.changes = append(nh.changes, c)
+	return saveJSON(nh.path, nh.changes)
+}
+
+// involving returns every change in the chain of names that leads to or
+// from name, so it shows who someone was before, and who they became.
+func (nh *nameHistory) involving(name string) []*nameChange {
+	names := map[string]bool{name: true}
+	for found := true; found; {
+		found = false
+		for _, c := range nh.changes {
+			if names[c.Old] != names[c.New] {
+				names[c.Old], names[c.New] = true, true
+				found = true
+			}
+		}
+	}
+	var changes []*nameChange
+	for _, c := range nh.changes {
+		if names[c.Old] {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// A reservation keeps a name that someone just stopped using for them.
+type reservation struct {
+	user  *User
+	until time.Time
+}
+
+// reservedFor reports whether name is being kept for somebody other than u.
+func (h *hub) reservedFor(name string, u *User) bool {
+	r, ok := h.reserved[name]
+	if !ok {
+		return false
+	}
+	if time.Now().After(r.until) {
+		delete(h.reserved, name)
+		return false
+	}
+	return r.user != u
+}
+
+// nameAvailable reports whether someone connecting can use name. It's safe
+// to call from outside the hub's goroutine.
+func (h *hub) nameAvailable(name string) bool {
+	available := false
+	h.do(func() {
+		_, taken := h.users[name]
+		available = !taken && !h.reservedFor(name, nil)
+	})
+	return available
+}
+
+// nick changes a user's name. The channel of the message is the name they
+// want. Everything kept by name moves over to the new one, and everyone who
+// shares a channel with them is told.
+func (h *hub) nick(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	old, name := user.name, m.Channel
+	var problem string
+	switch err := checkName(name); {
+	case user.credential != nil:
+		problem = "Names can't be changed through the API."
+	case name == old:
+		problem = "You're already called " + name + "."
+	case err != nil:
+		problem = err.Error()
+	case h.users[name] != nil || h.reservedFor(name, user):
+		problem = "The name " + name + " is already taken."
+	case h.bans.nameBanned(name) != nil:
+		problem = "The name " + name + " is banned."
+	case name != user.account && h.accounts.exists(name):
+		problem = "The name " + name + " is registered to somebody else."
+	}
+	if problem != "" {
+		user.conn.write(newMessage("you", "server", problem+"\n", text))
+		return
+	}
+
+	delete(h.users, old)
+	user.name = name
+	h.users[name] = user
+	for _, ch := range h.channels {
+		ch.rename(old, name, user.account == "")
+	}
+	if user.account == "" {
+		h.saveChannels()
+	}
+	if h.ignores.rename(old, name) {
+		if err := h.ignores.save(); err != nil {
+			h.logger.Println("Unable to save mutes:", err.Error())
+		}
+	}
+	h.limiter.rename(old, name)
+	h.markers.rename(old, name)
+	now := time.Now()
+	for n, r := range h.reserved {
+		if now.After(r.until) {
+			delete(h.reserved, n)
+		}
+	}
+	h.reserved[old] = &reservation{user: user, until: now.Add(nameReservation)}
+	delete(h.reserved, name)
+	err := h.names.record(&nameChange{
+		Old:     old,
+		New:     name,
+		Account: user.account,
+		Addr:    user.addr,
+		Time:    now,
+	})
+	if err != nil {
+		h.logger.Println("Unable to save name history:", err.Error())
+	}
+	h.logger.Printf("(%s is now known as %s)", old, name)
+
+	// The user's connection is told first, so it sends anything else as
+	// the new name.
+	user.conn.write(newMessage(name, old, "You're now known as "+name+".\n", nick))
+	for _, ch := range h.channels {
+		if ch.users[user] {
+			ch.broadcast(newMessage(ch.name, old, old+" is now known as "+name+".\n", nick))
+		}
+	}
+}
+
+// rename moves everything the channel keeps by name from old to name. A
+// guest's standing in the channel is kept under their name too, so it moves
+// when guest is true.
+func (c *channel) rename(old, name string, guest bool) {
+	if guest && c.owner == old {
+		c.owner = name
+	}
+	if guest && c.ops[old] {
+		delete(c.ops, old)
+		c.ops[name] = true
+	}
+	if guest && c.invited[old] {
+		delete(c.invited, old)
+		c.invited[name] = true
+	}
+	if t, ok := c.lastPost[old]; ok {
+		delete(c.lastPost, old)
+		c.lastPost[name] = t
+	}
+}
+
+// rename moves the mutes and blocks made by and of old over to name,
+// reporting whether there were any.
+func (l *ignoreList) rename(old, name string) bool {
+	changed := false
+	for _, sets := range []map[string]map[string]bool{l.muted, l.blocked} {
+		if set, ok := sets[old]; ok {
+			delete(sets, old)
+			sets[name] = set
+			changed = true
+		}
+		for _, set := range sets {
+			if set[old] {
+				delete(set, old)
+				set[name] = true
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// rename moves the rate limits and flooding record of old over to name, so
+// changing names can't be used to get around them.
+func (l *limiter) rename(old, name string) {
+	prefix := "user:" + old + "\x00"
+	for key, b := range l.buckets {
+		if strings.HasPrefix(key, prefix) {
+			delete(l.buckets, key)
+			l.buckets["user:"+name+"\x00"+strings.TrimPrefix(key, prefix)] = b
+		}
+	}
+	if o, ok := l.offenders[old]; ok {
+		delete(l.offenders, old)
+		l.offenders[name] = o
+	}
+}
+
+// whowas tells a moderator the names someone has gone by. The channel of the
+// message is the name to look up.
+func (h *hub) whowas(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.authorize(user, permModerate) {
+		user.conn.write(newMessage("you", "server", "Only moderators can do that.\n", text))
+		return
+	}
+	changes := h.names.involving(m.Channel)
+	if len(changes) == 0 {
+		user.conn.write(newMessage("you", "server", m.Channel+" hasn't changed names.\n", text))
+		return
+	}
+	lines := []string{"Names for " + m.Channel + ":"}
+	for _, c := range changes {
+		line := "  " + c.Time.Format("Jan 2 15:04") + " " + c.Old + " -> " + c.New
+		if c.Account != "" {
+			line += " (account " + c.Account + ")"
+		}
+		if c.Addr != "" {
+			line += " from " + c.Addr
+		}
+		lines = append(lines, line)
+	}
+	user.conn.write(newMessage("you", "server", strings.Join(lines, "\n")+"\n", text))
+}
@@ -0,0 +1,54 @@
+package chat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// loadJSON decodes the file at path into v. A missing file isn't an error,
+// since that's how everything starts out, and neither is an empty path,
+// which means nothing is being persisted.
+func loadJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON encodes v to the file at path. It writes to a temporary file
+// first and renames it into place, so a crash can't leave a half written
+// file behind.
+func saveJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// dataPath returns the path of the named file in the config's data
+// directory, or an empty path if nothing is being persisted.
+func dataPath(cfg *Config, name string) string {
+	if cfg.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.DataDir, name)
+}
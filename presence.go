@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A presence says whether someone is around to talk to.
+type presence int
+
+const (
+	presenceOnline presence = iota
+	presenceAway
+	// presenceDND is do not disturb, for people who are around, but busy.
+	presenceDND
+)
+
+func (p presence) String() string {
+	switch p {
+	case presenceAway:
+		return "away"
+	case presenceDND:
+		return "dnd"
+	}
+	return "online"
+}
+
+// The transports someone can be connected with, or send messages through.
+const (
+	transportTCP = "TCP"
+	transportTLS = "TLS"
+	transportWS  = "WS"
+	transportAPI = "API"
+)
+
+// touch records that m's sender just did something.
+func (h *hub) touch(m *Message) {
+	if user, ok := h.sender(m); ok {
+		user.lastActive = time.Now()
+	}
+}
+
+// setPresence marks a user as away, do not disturb, or back, depending on
+// the type of the message. The text of the message is what to tell people
+// who send them direct messages while they're gone.
+func (h *hub) setPresence(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	user.awayMessage = strings.TrimSpace(m.Text)
+	user.awayReplied = nil
+	var reply string
+	switch m.MessageType {
+	case away:
+		user.presence = presenceAway
+		reply = "You're marked as away."
+	case dnd:
+		user.presence = presenceDND
+		reply = "Do not disturb is on."
+	case back:
+		if user.presence == presenceOnline {
+			reply = "You weren't away."
+		} else {
+			reply = "Welcome back."
+		}
+		user.presence = presenceOnline
+		user.awayMessage = ""
+	}
+	h.logger.Printf("(%s is %s)", user.name, user.presence)
+	user.conn.write(newMessage("you", "server", reply+"\n", text))
+}
+
+// awayReply tells the sender of a direct message if its recipient is away,
+// but only the first time, so a conversation doesn't fill up with them.
+func (h *hub) awayReply(sender, recipient *User) {
+	if recipient.presence == presenceOnline || recipient.awayReplied[sender.name] {
+		return
+	}
+	if recipient.awayReplied == nil {
+		recipient.awayReplied = make(map[string]bool)
+	}
+	recipient.awayReplied[sender.name] = true
+	sender.conn.write(newMessage("you", "server", describePresence(recipient)+"\n", text))
+}
+
+// describePresence says whether u is around, along with their away message.
+func describePresence(u *User) string {
+	s := u.name + " is " + u.presence.String()
+	if u.presence == presenceDND {
+		s = u.name + " doesn't want to be disturbed"
+	}
+	if u.awayMessage != "" {
+		s += ": " + u.awayMessage
+	}
+	return s
+}
+
+// whois tells a user about someone else. The channel of the message is the
+// name of the user to look up. Moderators also see where they're connected
+// from.
+func (h *hub) whois(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	target, ok := h.users[m.Channel]
+	if !ok {
+		if seen, ok := h.apiSeen[m.Channel]; ok {
+			user.conn.write(newMessage("you", "server", m.Channel+" isn't connected, but used the API "+ago(seen)+".\n", text))
+			return
+		}
+		user.conn.write(newMessage("you", "server", "The user "+m.Channel+" isn't connected.\n", text))
+		return
+	}
+
+	lines := []string{describePresence(target)}
+	lines = append(lines, "  connected over "+target.transport+" "+ago(target.connected)+", last active "+ago(target.lastActive))
+	if target.account != "" {
+		lines = append(lines, "  logged in as "+target.account+", with the "+target.role.String()+" role")
+	}
+	var chans []string
+	for name, ch := range h.channels {
+		if ch.users[target] && ch.visibleTo(user) {
+			chans = append(chans, name)
+		}
+	}
+	if len(chans) > 0 {
+		sort.Strings(chans)
+		lines = append(lines, "  in "+strings.Join(chans, ", "))
+	}
+	if h.authorize(user, permModerate) && target.addr != "" {
+		lines = append(lines, "  from "+target.addr)
+	}
+	user.conn.write(newMessage("you", "server", strings.Join(lines, "\n")+"\n", text))
+}
+
+// ago describes how long it's been since t, like "5m0s ago".
+func ago(t time.Time) string {
+	d := time.Since(t).Round(time.Second)
+	if d < time.Second {
+		return "just now"
+	}
+	return d.String() + " ago"
+}
+
+// A presenceInfo describes whether someone is around to API clients.
+type presenceInfo struct {
+	Name       string
+	Status     string
+	Message    string `json:",omitempty"`
+	Transport  string
+	Connected  *time.Time `json:",omitempty"`
+	LastActive time.Time
+}
+
+// presence returns the presence of everyone who's connected, or has used
+// the API, sorted by name. It's safe to call from outside the hub's
+// goroutine.
+func (h *hub) presence() []*presenceInfo {
+	infos := []*presenceInfo{}
+	h.do(func() {
+		for _, u := range h.users {
+			connected := u.connected
+			infos = append(infos, &presenceInfo{
+				Name:       u.name,
+				Status:     u.presence.String(),
+				Message:    u.awayMessage,
+				Transport:  u.transport,
+				Connected:  &connected,
+				LastActive: u.lastActive,
+			})
+		}
+		for name, seen := range h.apiSeen {
+			if _, ok := h.users[name]; ok {
+				continue
+			}
+			infos = append(infos, &presenceInfo{
+				Name:       name,
+				Status:     presenceOnline.String(),
+				Transport:  transportAPI,
+				LastActive: seen,
+			})
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
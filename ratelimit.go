@@ -0,0 +1,251 @@
+package chat
+
+import (
+	"time"
+)
+
+// A RateLimit is a token bucket. Rate is how many messages can be sent each
+// second on average, and Burst is how many can be sent at once.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// A FloodConfig sets how quickly messages can be sent, and what happens to
+// people who send them faster than that.
+type FloodConfig struct {
+	// Users and IPs are the limits for each user and each address, keyed by
+	// the name of a message type, like "text" or "dm". Types that aren't
+	// listed use the "default" limit.
+	Users map[string]RateLimit
+	IPs   map[string]RateLimit
+
+	// Warnings is how many times a user is warned before being muted, and
+	// MuteFor is how long the mute lasts, like "1m". After being muted Mutes
+	// times, they're disconnected instead.
+	Warnings int
+	MuteFor  string
+	Mutes    int
+}
+
+var (
+	defaultUserLimits = map[string]RateLimit{
+		"default": {Rate: 2, Burst: 10},
+	}
+	defaultIPLimits = map[string]RateLimit{
+		"default": {Rate: 10, Burst: 50},
+	}
+)
+
+const (
+	defaultFloodWarnings = 3
+	defaultFloodMuteFor  = time.Minute
+	defaultFloodMutes    = 3
+
+	// offenseMemory is how long it takes for a user's warnings and mutes to
+	// be forgotten, if they stop flooding.
+	offenseMemory = 10 * time.Minute
+)
+
+// loginLimit is how often passwords can be checked for each address. Every
+// check takes a while on purpose, so without a limit, logging in could be
+// used to guess passwords, or just to keep the server busy.
+var loginLimit = RateLimit{Rate: 0.1, Burst: 10}
+
+// typingLimit is how many typing messages each user can send. Clients send
+// them with every keystroke, so it's generous, and going over it just drops
+// them, rather than counting as flooding.
+var typingLimit = RateLimit{Rate: 10, Burst: 30}
+
+// A bucket holds the tokens left for one user or address, and one type of
+// message.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used, then takes a
+// token from it if there's one left.
+func (b *bucket) take(l RateLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// An offender is a user who's been caught flooding.
+type offender struct {
+	warnings   int
+	mutes      int
+	mutedUntil time.Time
+	last       time.Time
+}
+
+// A limiter keeps track of how quickly each user and address is sending
+// messages. It's only used by the hub's goroutine.
+type limiter struct {
+	users     map[string]RateLimit
+	ips       map[string]RateLimit
+	warnings  int
+	muteFor   time.Duration
+	mutes     int
+	buckets   map[string]*bucket
+	offenders map[string]*offender
+	swept     time.Time
+}
+
+func newLimiter(cfg *FloodConfig) (*limiter, error) {
+	l := &limiter{
+		users:     cfg.Users,
+		ips:       cfg.IPs,
+		warnings:  cfg.Warnings,
+		muteFor:   defaultFloodMuteFor,
+		mutes:     cfg.Mutes,
+		buckets:   make(map[string]*bucket),
+		offenders: make(map[string]*offender),
+		swept:     time.Now(),
+	}
+	if l.users == nil {
+		l.users = defaultUserLimits
+	}
+	if l.ips == nil {
+		l.ips = defaultIPLimits
+	}
+	if l.warnings == 0 {
+		l.warnings = defaultFloodWarnings
+	}
+	if l.mutes == 0 {
+		l.mutes = defaultFloodMutes
+	}
+	if cfg.MuteFor != "" {
+		d, err := time.ParseDuration(cfg.MuteFor)
+		if err != nil {
+			return nil, err
+		}
+		l.muteFor = d
+	}
+	return l, nil
+}
+
+// take reports whether the key can send another message of type t, given
+// the limits for that kind of key.
+func (l *limiter) take(limits map[string]RateLimit, key string, t MessageType, now time.Time) bool {
+	limit, ok := limits[t.String()]
+	if !ok {
+		limit, ok = limits["default"]
+	}
+	if !ok || limit.Rate <= 0 {
+		return true
+	}
+	return l.takeFrom(key+"\x00"+t.String(), limit, now)
+}
+
+// takeFrom takes a token from the bucket with the given key, which starts off
+// full.
+func (l *limiter) takeFrom(key string, limit RateLimit, now time.Time) bool {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(limit, now)
+}
+
+// sweep forgets about buckets that have refilled and offenders that have
+// behaved for a while, so they don't pile up forever.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > offenseMemory {
+			delete(l.buckets, key)
+		}
+	}
+	for name, o := range l.offenders {
+		if now.Sub(o.last) > offenseMemory && now.After(o.mutedUntil) {
+			delete(l.offenders, name)
+		}
+	}
+}
+
+// allowLogin reports whether a password can be checked for someone at addr,
+// or whether they've tried too many lately. It's safe to call from outside
+// the hub's goroutine.
+func (h *hub) allowLogin(addr string) bool {
+	allowed := false
+	h.do(func() {
+		now := time.Now()
+		l := h.limiter
+		l.sweep(now)
+		allowed = l.takeFrom("login:"+addr, loginLimit, now)
+	})
+	if !allowed {
+		h.logger.Printf("(too many logins from %s)", addr)
+	}
+	return allowed
+}
+
+// allow reports whether m should be handled, or dropped because its sender
+// is flooding. Users who keep flooding are warned, then muted for a while,
+// and eventually disconnected.
+func (h *hub) allow(m *Message) bool {
+	// Leaving always works, or flooders could never be disconnected.
+	if m.MessageType == quit {
+		return true
+	}
+	now := time.Now()
+	l := h.limiter
+	l.sweep(now)
+	if m.MessageType == typing {
+		return l.takeFrom("user:"+m.Username+"\x00"+typing.String(), typingLimit, now)
+	}
+
+	user, ok := h.sender(m)
+	addr := m.addr
+	if addr == "" && ok {
+		addr = user.addr
+	}
+	o := l.offenders[m.Username]
+	if o != nil && now.Before(o.mutedUntil) {
+		return false
+	}
+
+	if l.take(l.users, "user:"+m.Username, m.MessageType, now) &&
+		(addr == "" || l.take(l.ips, "ip:"+addr, m.MessageType, now)) {
+		return true
+	}
+	h.logger.Printf("(%s from %s is flooding): %s", m.Username, addr, m.MessageType)
+	if !ok {
+		return false
+	}
+
+	if o == nil || now.Sub(o.last) > offenseMemory {
+		o = &offender{}
+		l.offenders[m.Username] = o
+	}
+	o.last = now
+	o.warnings++
+	if o.warnings <= l.warnings {
+		user.conn.write(newMessage("you", "server", "You're sending messages too quickly. Slow down, or you'll be muted.\n", text))
+		return false
+	}
+
+	o.warnings = 0
+	o.mutes++
+	if o.mutes > l.mutes {
+		delete(l.offenders, m.Username)
+		h.disconnect(user, "You've been disconnected for flooding", "")
+		return false
+	}
+	o.mutedUntil = now.Add(l.muteFor)
+	user.conn.write(newMessage("you", "server", "You've been muted for "+l.muteFor.String()+" for flooding. Nothing you send until then will go through.\n", text))
+	return false
+}
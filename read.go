@@ -0,0 +1,232 @@
+package chat
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// unreadScanLimit is the most unread messages in a channel that are checked
+// for mentions.
+const unreadScanLimit = 1000
+
+// readMarkers hold how far through each channel everyone has read, as the
+// sequence number of the last message they've seen, keyed by user name and
+// then channel. They're only used by the hub's run loop, and they change so
+// often that they're saved by the run loop's ticker, rather than every time.
+type readMarkers struct {
+	path  string
+	marks map[string]map[string]uint64
+	dirty bool
+}
+
+func newReadMarkers(path string) (*readMarkers, error) {
+	rm := &readMarkers{
+		path:  path,
+		marks: make(map[string]map[string]uint64),
+	}
+	if err := loadJSON(path, &rm.marks); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+// get returns how far name has read through channel, and whether they've
+// ever been in it.
+func (rm *readMarkers) get(name, channel string) (uint64, bool) {
+	seq, ok := rm.marks[name][channel]
+	return seq, ok
+}
+
+// advance moves name's marker for channel up to seq. Markers never move
+// backwards, so reading old history doesn't make newer messages unread.
+func (rm *readMarkers) advance(name, channel string, seq uint64) {
+	marks, ok := rm.marks[name]
+	if !ok {
+		marks = make(map[string]uint64)
+		rm.marks[name] = marks
+	}
+	if cur, ok := marks[channel]; ok && cur >= seq {
+		return
+	}
+	marks[channel] = seq
+	rm.dirty = true
+}
+
+// rename moves old's markers over to name.
+func (rm *readMarkers) rename(old, name string) {
+	if marks, ok := rm.marks[old]; ok {
+		delete(rm.marks, old)
+		rm.marks[name] = marks
+		rm.dirty = true
+	}
+}
+
+// save writes the markers to disk if they've changed since they were last
+// saved.
+func (rm *readMarkers) save() error {
+	if !rm.dirty {
+		return nil
+	}
+	rm.dirty = false
+	return saveJSON(rm.path, rm.marks)
+}
+
+// lastSeq returns the sequence number of the last message in the named log.
+func (h *hub) lastSeq(name string) (uint64, error) {
+	if seq, ok := h.seqs[name]; ok {
+		return seq, nil
+	}
+	return h.store.LastSeq(name)
+}
+
+// startReading starts u's marker for ch at its latest message when they
+// join it for the first time, so its whole history isn't unread.
+func (h *hub) startReading(u *User, ch *channel) {
+	if _, ok := h.markers.get(u.name, ch.name); ok {
+		return
+	}
+	seq, err := h.lastSeq(ch.name)
+	if err != nil {
+		h.logger.Println("Unable to read history:", err.Error())
+		return
+	}
+	h.markers.advance(u.name, ch.name, seq)
+}
+
+// markRead moves the sender's read marker for a channel up to the Seq of the
+// message, or to the latest message if it's zero.
+func (h *hub) markRead(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.canRead(user, m.Channel) {
+		user.conn.write(newMessage("you", "server", "Channel "+m.Channel+" doesn't exist.\n", text))
+		return
+	}
+	last, err := h.lastSeq(m.Channel)
+	if err != nil {
+		h.logger.Println("Unable to read history:", err.Error())
+		return
+	}
+	seq := m.Seq
+	if seq == 0 || seq > last {
+		seq = last
+	}
+	h.markers.advance(m.Username, m.Channel, seq)
+}
+
+// An unreadInfo is how much someone hasn't read in a channel.
+type unreadInfo struct {
+	Channel  string
+	LastRead uint64
+	Unread   uint64
+	Mentions int
+}
+
+// unreadFor returns how much u hasn't read in each channel they're in, or
+// for API sessions, in each channel they can read and have read before.
+func (h *hub) unreadFor(u *User) []*unreadInfo {
+	infos := []*unreadInfo{}
+	for _, ch := range h.channels {
+		mark, ok := h.markers.get(u.name, ch.name)
+		switch {
+		case u.credential == nil && !ch.users[u]:
+			continue
+		case u.credential != nil && (!ok || !ch.readableBy(u)):
+			continue
+		}
+		last, err := h.lastSeq(ch.name)
+		if err != nil {
+			h.logger.Println("Unable to read history:", err.Error())
+			continue
+		}
+		info := &unreadInfo{Channel: ch.name, LastRead: mark}
+		if last > mark {
+			info.Unread = last - mark
+			info.Mentions = h.countMentions(ch.name, u.name, mark, last)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Channel < infos[j].Channel })
+	return infos
+}
+
+// countMentions counts the messages after mark in the named channel that
+// mention name, looking at no more than the last unreadScanLimit of them.
+func (h *hub) countMentions(channel, name string, mark, last uint64) int {
+	limit := unreadScanLimit
+	if last-mark < uint64(limit) {
+		limit = int(last - mark)
+	}
+	msgs, _, err := h.store.Page(channel, 0, limit)
+	if err != nil {
+		h.logger.Println("Unable to read history:", err.Error())
+		return 0
+	}
+	n := 0
+	for _, m := range msgs {
+		if m.Seq > mark && m.MessageType == text && !m.Deleted && m.Username != name && mentions(m.Text, name) {
+			n++
+		}
+	}
+	return n
+}
+
+// mentions reports whether s mentions name, like "@rob", but not "@robert".
+func mentions(s, name string) bool {
+	s, at := strings.ToLower(s), "@"+strings.ToLower(name)
+	for {
+		i := strings.Index(s, at)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(at):]
+		r, _ := utf8.DecodeRuneInString(s)
+		if s == "" || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			return true
+		}
+	}
+}
+
+// unread tells a user how many messages they haven't read in each of their
+// channels, and how many of those mention them.
+func (h *hub) unread(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	var lines []string
+	for _, info := range h.unreadFor(user) {
+		if info.Unread == 0 {
+			continue
+		}
+		line := "  " + info.Channel + ": " + strconv.FormatUint(info.Unread, 10) + " unread"
+		switch info.Mentions {
+		case 0:
+		case 1:
+			line += ", 1 mention"
+		default:
+			line += ", " + strconv.Itoa(info.Mentions) + " mentions"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		user.conn.write(newMessage("you", "server", "You're all caught up.\n", text))
+		return
+	}
+	user.conn.write(newMessage("you", "server", "Unread messages:\n"+strings.Join(lines, "\n")+"\n", text))
+}
+
+// unreadInfo returns how much the holder of c hasn't read. It's safe to call
+// from outside the hub's goroutine.
+func (h *hub) unreadInfo(c *credential) []*unreadInfo {
+	var infos []*unreadInfo
+	h.do(func() {
+		infos = h.unreadFor(h.newSession(c, ""))
+	})
+	return infos
+}
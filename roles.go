@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+)
+
+// A role is what a user is allowed to do across the whole server. Each role
+// can do everything the ones before it can.
+type role int
+
+const (
+	roleGuest role = iota
+	roleUser
+	roleModerator
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleGuest:
+		return "guest"
+	case roleModerator:
+		return "moderator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "user"
+}
+
+// parseRole parses the name of a role, as used in the config. An empty name
+// is the user role.
+func parseRole(s string) (role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "guest":
+		return roleGuest, nil
+	case "", "user":
+		return roleUser, nil
+	case "moderator":
+		return roleModerator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleUser, errors.New("unknown role " + s)
+}
+
+// A permission is something only some roles are allowed to do.
+type permission int
+
+const (
+	permCreateChannel permission = iota
+	permDM
+	// permModerate lets a user act as an operator of every channel.
+	permModerate
+	permAdmin
+)
+
+// minRoles is the least privileged role that has each permission.
+var minRoles = map[permission]role{
+	permCreateChannel: roleUser,
+	permDM:            roleUser,
+	permModerate:      roleModerator,
+	permAdmin:         roleAdmin,
+}
+
+// authorize reports whether u has permission p. Every check of a user's role
+// should go through here.
+func (h *hub) authorize(u *User, p permission) bool {
+	return u.role >= minRoles[p]
+}
+
+// roleFor returns the role the config gives the named account. Only users
+// who've logged in can have the roles given to particular names, so anyone
+// without an account gets the default role.
+func (h *hub) roleFor(name string) role {
+	r, _ := parseRole(h.cfg.DefaultRole)
+	if name == "" {
+		return r
+	}
+	for _, admin := range h.cfg.Admins {
+		if admin == name {
+			return roleAdmin
+		}
+	}
+	for _, mod := range h.cfg.Moderators {
+		if mod == name {
+			return roleModerator
+		}
+	}
+	return r
+}
+
+// isOperator reports whether u can manage ch, either as one of its operators
+// or as a moderator.
+func (h *hub) isOperator(u *User, ch *channel) bool {
+	return ch.isOperator(u.id()) || h.authorize(u, permModerate)
+}
@@ -0,0 +1,253 @@
+package chat
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errMessageNotFound = errors.New("message not found")
+
+// A MessageStore records the messages that pass through the hub so they can
+// be read back later, for example after a restart.
+type MessageStore interface {
+	// Append records m at the end of the log it belongs to.
+	Append(m *Message) error
+
+	// Page returns up to limit messages from the named log with sequence
+	// numbers lower than before, oldest first, along with the cursor for the
+	// page before that. A cursor of zero starts from the most recent message,
+	// and a returned cursor of zero means there's nothing older.
+	Page(name string, before uint64, limit int) ([]*Message, uint64, error)
+
+	// After returns up to limit messages from the named log with sequence
+	// numbers higher than after, oldest first.
+	After(name string, after uint64, limit int) ([]*Message, error)
+
+	// Message returns the stored message with the given ID, with any edits
+	// made to it applied.
+	Message(id uint64) (*Message, error)
+
+	// Thread returns the message with the given ID, and every reply to it,
+	// oldest first.
+	Thread(id uint64) (*Message, []*Message, error)
+
+	// LastID returns the highest message ID in the store.
+	LastID() (uint64, error)
+
+	// LastSeq returns the sequence number of the last message in the named
+	// log, or zero if it's empty.
+	LastSeq(name string) (uint64, error)
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// logName returns the name of the log a message is stored in. Direct messages
+// go in a log shared by both users, so it doesn't matter which of them sent
+// it.
+func logName(m *Message) string {
+	if m.MessageType != dm {
+		return m.Channel
+	}
+	a, b := m.Username, m.Channel
+	if a > b {
+		a, b = b, a
+	}
+	return "@" + a + "," + b
+}
+
+// A memoryStore keeps every log in memory. Nothing survives a restart, so
+// it's mostly useful for tests, or when no data directory is configured.
+type memoryStore struct {
+	mu      sync.RWMutex
+	logs    map[string][]*Message
+	byID    map[uint64]*Message
+	replies map[uint64][]*Message
+	lastID  uint64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		logs:    make(map[string][]*Message),
+		byID:    make(map[uint64]*Message),
+		replies: make(map[uint64][]*Message),
+	}
+}
+
+func (s *memoryStore) Append(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.append(m)
+	return nil
+}
+
+// append adds a copy of m to its log, so callers are free to keep using m
+// afterwards. Edits, removals and reactions don't take a place in the log,
+// and are applied to the message they target instead. The caller must hold the lock.
+func (s *memoryStore) append(m *Message) {
+	switch m.MessageType {
+	case edit, remove, react, unreact:
+		s.apply(m)
+		return
+	}
+
+	cp := copyMessage(m)
+	name := logName(m)
+	log := s.logs[name]
+	// Messages stored before sequence numbers existed are numbered by their
+	// position in the log, which is what they'd have been given anyway.
+	if cp.Seq == 0 {
+		cp.Seq = uint64(len(log) + 1)
+	}
+	if cp.ID > s.lastID {
+		s.lastID = cp.ID
+	}
+	if cp.ID > 0 {
+		s.byID[cp.ID] = cp
+	}
+	if cp.ReplyTo > 0 {
+		s.replies[cp.ReplyTo] = append(s.replies[cp.ReplyTo], cp)
+	}
+	s.logs[name] = append(log, cp)
+}
+
+// apply changes the message targeted by an edit, removal or reaction. The
+// caller must hold the lock.
+func (s *memoryStore) apply(m *Message) {
+	target, ok := s.byID[m.Target]
+	if !ok {
+		return
+	}
+	switch m.MessageType {
+	case edit:
+		target.Text = m.Text
+		target.Edited = true
+	case remove:
+		target.Text = ""
+		target.Deleted = true
+	case react:
+		if target.Reactions == nil {
+			target.Reactions = make(map[string][]string)
+		}
+		for _, name := range target.Reactions[m.Text] {
+			if name == m.Username {
+				return
+			}
+		}
+		target.Reactions[m.Text] = append(target.Reactions[m.Text], m.Username)
+	case unreact:
+		names := target.Reactions[m.Text]
+		for i, name := range names {
+			if name == m.Username {
+				names = append(names[:i:i], names[i+1:]...)
+				break
+			}
+		}
+		if len(names) == 0 {
+			delete(target.Reactions, m.Text)
+			return
+		}
+		target.Reactions[m.Text] = names
+	}
+}
+
+func (s *memoryStore) Message(id uint64) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.byID[id]
+	if !ok {
+		return nil, errMessageNotFound
+	}
+	return copyMessage(m), nil
+}
+
+func (s *memoryStore) Thread(id uint64) (*Message, []*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.byID[id]
+	if !ok {
+		return nil, nil, errMessageNotFound
+	}
+	return copyMessage(m), copyMessages(s.replies[id]), nil
+}
+
+func (s *memoryStore) Page(name string, before uint64, limit int) ([]*Message, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	log := s.logs[name]
+	end := len(log)
+	if before > 0 {
+		end = sort.Search(len(log), func(i int) bool { return log[i].Seq >= before })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	var next uint64
+	if start > 0 {
+		next = log[start].Seq
+	}
+	return copyMessages(log[start:end]), next, nil
+}
+
+func (s *memoryStore) After(name string, after uint64, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	log := s.logs[name]
+	start := sort.Search(len(log), func(i int) bool { return log[i].Seq > after })
+	end := start + limit
+	if end > len(log) {
+		end = len(log)
+	}
+	return copyMessages(log[start:end]), nil
+}
+
+func (s *memoryStore) LastID() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastID, nil
+}
+
+func (s *memoryStore) LastSeq(name string) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	log := s.logs[name]
+	if len(log) == 0 {
+		return 0, nil
+	}
+	return log[len(log)-1].Seq, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copyMessages returns a copy of msgs that is safe to hand out after the
+// store's lock has been released.
+func copyMessages(msgs []*Message) []*Message {
+	out := make([]*Message, len(msgs))
+	for i, m := range msgs {
+		out[i] = copyMessage(m)
+	}
+	return out
+}
+
+// copyMessage returns a copy of m that doesn't share its reactions or
+// annotations, since those can change after it's been stored.
+func copyMessage(m *Message) *Message {
+	cp := *m
+	if m.Reactions != nil {
+		cp.Reactions = make(map[string][]string, len(m.Reactions))
+		for r, names := range m.Reactions {
+			cp.Reactions[r] = append([]string(nil), names...)
+		}
+	}
+	if m.Meta != nil {
+		cp.Meta = make(map[string]string, len(m.Meta))
+		for k, v := range m.Meta {
+			cp.Meta[k] = v
+		}
+	}
+	return &cp
+}
@@ -0,0 +1,309 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// segmentSize is the number of messages written to a segment file before a
+// new one is started.
+const segmentSize = 1000
+
+// A fileStore is an append-only, file backed MessageStore. Each log gets its
+// own directory, which holds a series of numbered segment files containing
+// one JSON encoded message per line. Everything is read into memory when the
+// store is opened, and new messages are written straight to the newest
+// segment. Segments are only ever rewritten to scrub the text of deleted
+// messages from them.
+type fileStore struct {
+	*memoryStore
+	dir string
+
+	mu       sync.Mutex
+	segments map[string]*segment
+
+	// where holds the indexes of the segments that have the text of the
+	// message with each ID in them, which are the ones with the message
+	// itself, and with any edits to it.
+	where map[uint64][]int
+}
+
+// A segment is the file a log is currently being appended to.
+type segment struct {
+	f     *os.File
+	index int
+	count int
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		dir:         dir,
+		segments:    make(map[string]*segment),
+		where:       make(map[uint64][]int),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(e.Name())
+		if err != nil {
+			continue
+		}
+		if err := s.load(name); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load reads every segment of the named log into memory, and opens the
+// newest one for appending.
+func (s *fileStore) load(name string) error {
+	dir := s.logDir(name)
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	seg := &segment{}
+	for _, path := range files {
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d.log", &seg.index); err != nil {
+			continue
+		}
+		seg.count, err = s.loadSegment(path, seg.index)
+		if err != nil {
+			return err
+		}
+	}
+	if seg.index == 0 {
+		return nil
+	}
+	seg.f, err = os.OpenFile(segmentPath(dir, seg.index), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.segments[name] = seg
+	return nil
+}
+
+func (s *fileStore) loadSegment(path string, index int) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		m := &Message{}
+		// A partially written line is what we'd expect to find after a
+		// crash, so skip it rather than refusing to start.
+		if err := json.Unmarshal(sc.Bytes(), m); err != nil {
+			continue
+		}
+		s.memoryStore.append(m)
+		s.locate(m, index)
+		count++
+	}
+	return count, sc.Err()
+}
+
+func (s *fileStore) Append(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := logName(m)
+	seg, err := s.segment(name)
+	if err != nil {
+		return err
+	}
+	if _, err := seg.f.Write(b); err != nil {
+		return err
+	}
+	seg.count++
+	if err := s.memoryStore.Append(m); err != nil {
+		return err
+	}
+	s.locate(m, seg.index)
+	if m.MessageType == remove {
+		return s.scrub(name, m.Target)
+	}
+	return nil
+}
+
+// locate notes that m was written to the segment with the given index, if it
+// has text that would need scrubbing when the message is deleted.
+func (s *fileStore) locate(m *Message, index int) {
+	id := m.ID
+	switch m.MessageType {
+	case text, dm:
+	case edit:
+		id = m.Target
+	default:
+		return
+	}
+	if id == 0 {
+		return
+	}
+	if where := s.where[id]; len(where) == 0 || where[len(where)-1] != index {
+		s.where[id] = append(where, index)
+	}
+}
+
+// scrub blanks the text of the message with the given ID, and of every edit
+// made to it, in the segments of the named log they were written to. Deleting
+// a message only appends to its log, so otherwise, what it said would stay on
+// disk. The caller must hold the lock.
+func (s *fileStore) scrub(name string, id uint64) error {
+	for _, index := range s.where[id] {
+		err := s.rewrite(name, index, func(m *Message) bool {
+			if m.Text == "" || (m.ID != id && (m.MessageType != edit || m.Target != id)) {
+				return false
+			}
+			m.Text = ""
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	delete(s.where, id)
+	return nil
+}
+
+// rewrite replaces a segment of the named log with a copy where fn has been
+// called on every message, and the ones it reports changing are written out
+// again. The copy is only swapped in once it's been written. The caller must
+// hold the lock.
+func (s *fileStore) rewrite(name string, index int, fn func(m *Message) bool) error {
+	path := segmentPath(s.logDir(name), index)
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		m := &Message{}
+		if err := json.Unmarshal(line, m); err == nil && fn(m) {
+			if line, err = json.Marshal(m); err != nil {
+				return err
+			}
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// The newest segment is kept open for appending, so it has to be opened
+	// again now that it's been replaced.
+	if seg, ok := s.segments[name]; ok && seg.index == index {
+		seg.f.Close()
+		if seg.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			// Marking it as full starts a new segment for the next
+			// message.
+			seg.count = segmentSize
+			return err
+		}
+	}
+	return nil
+}
+
+// segment returns the segment the named log should be appended to, starting
+// a new one if the current segment is full. The caller must hold the lock.
+func (s *fileStore) segment(name string) (*segment, error) {
+	seg, ok := s.segments[name]
+	if ok && seg.count < segmentSize {
+		return seg, nil
+	}
+
+	next := &segment{index: 1}
+	if ok {
+		seg.f.Close()
+		next.index = seg.index + 1
+	}
+	dir := s.logDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(segmentPath(dir, next.index), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	next.f = f
+	s.segments[name] = next
+	return next, nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for name, seg := range s.segments {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.segments, name)
+	}
+	return err
+}
+
+// logDir returns the directory the named log is kept in. Log names come from
+// users, so they're escaped to keep them inside the store's directory.
+func (s *fileStore) logDir(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return filepath.Join(s.dir, escaped)
+}
+
+func segmentPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d.log", index))
+}
@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fill appends n channel messages to s, numbered from one like the hub would.
+func fill(t *testing.T, s MessageStore, channel string, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		m := newMessage(channel, "rob", "hello", text)
+		m.ID, m.Seq = uint64(i), uint64(i)
+		if err := s.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seqs(msgs []*Message) []uint64 {
+	var out []uint64
+	for _, m := range msgs {
+		out = append(out, m.Seq)
+	}
+	return out
+}
+
+func equalSeqs(a []uint64, from, to uint64) bool {
+	if uint64(len(a)) != to-from+1 {
+		return false
+	}
+	for i, seq := range a {
+		if seq != from+uint64(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// testPaging checks that a store holding 25 messages in general pages through
+// them correctly.
+func testPaging(t *testing.T, s MessageStore) {
+	t.Helper()
+	msgs, next, err := s.Page("general", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalSeqs(seqs(msgs), 16, 25) || next != 16 {
+		t.Fatalf("first page: got %v, next %d", seqs(msgs), next)
+	}
+	msgs, next, _ = s.Page("general", next, 10)
+	if !equalSeqs(seqs(msgs), 6, 15) || next != 6 {
+		t.Fatalf("second page: got %v, next %d", seqs(msgs), next)
+	}
+	msgs, next, _ = s.Page("general", next, 10)
+	if !equalSeqs(seqs(msgs), 1, 5) || next != 0 {
+		t.Fatalf("last page: got %v, next %d", seqs(msgs), next)
+	}
+
+	msgs, _ = s.After("general", 20, 10)
+	if !equalSeqs(seqs(msgs), 21, 25) {
+		t.Fatalf("after 20: got %v", seqs(msgs))
+	}
+	msgs, _ = s.After("general", 25, 10)
+	if len(msgs) != 0 {
+		t.Fatalf("after the last message: got %v", seqs(msgs))
+	}
+	if seq, _ := s.LastSeq("general"); seq != 25 {
+		t.Fatalf("LastSeq: got %d, want 25", seq)
+	}
+	if seq, _ := s.LastSeq("random"); seq != 0 {
+		t.Fatalf("LastSeq of an empty log: got %d, want 0", seq)
+	}
+}
+
+func TestMemoryStorePaging(t *testing.T) {
+	s := newMemoryStore()
+	fill(t, s, "general", 25)
+	testPaging(t, s)
+}
+
+func TestMemoryStoreChanges(t *testing.T) {
+	s := newMemoryStore()
+	fill(t, s, "general", 1)
+	s.Append(&Message{Channel: "general", Username: "rob", Text: "changed", MessageType: edit, Target: 1})
+	s.Append(&Message{Channel: "general", Username: "ana", Text: ":+1:", MessageType: react, Target: 1})
+	m, err := s.Message(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Text != "changed" || !m.Edited || len(m.Reactions[":+1:"]) != 1 {
+		t.Fatalf("got %+v", m)
+	}
+	// What's handed out is a copy, so changing it doesn't change the store.
+	m.Reactions[":+1:"] = nil
+	if m, _ = s.Message(1); len(m.Reactions[":+1:"]) != 1 {
+		t.Fatal("changing a returned message changed the store")
+	}
+
+	s.Append(&Message{Channel: "general", Username: "rob", MessageType: remove, Target: 1})
+	if m, _ = s.Message(1); m.Text != "" || !m.Deleted {
+		t.Fatalf("got %+v after removing it", m)
+	}
+	if seq, _ := s.LastSeq("general"); seq != 1 {
+		t.Fatalf("changes took a place in the log: LastSeq is %d", seq)
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough to need a second segment.
+	fill(t, s, "general", segmentSize+5)
+	s.Append(&Message{Channel: "general", Username: "rob", Text: "changed", MessageType: edit, Target: 3})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(segmentPath(s.logDir("general"), 2)); err != nil {
+		t.Fatalf("no second segment: %v", err)
+	}
+
+	s, err = newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if id, _ := s.LastID(); id != segmentSize+5 {
+		t.Fatalf("LastID: got %d, want %d", id, segmentSize+5)
+	}
+	if m, err := s.Message(3); err != nil || m.Text != "changed" {
+		t.Fatalf("edit wasn't reloaded: %+v, %v", m, err)
+	}
+	msgs, next, _ := s.Page("general", 0, 10)
+	if !equalSeqs(seqs(msgs), segmentSize-4, segmentSize+5) || next != segmentSize-4 {
+		t.Fatalf("got %v, next %d", seqs(msgs), next)
+	}
+
+	// Appending carries on in the newest segment.
+	m := newMessage("general", "rob", "more", text)
+	m.ID, m.Seq = segmentSize+6, segmentSize+6
+	if err := s.Append(m); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := s.LastSeq("general"); seq != segmentSize+6 {
+		t.Fatalf("LastSeq: got %d", seq)
+	}
+}
+
+func TestFileStorePaging(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, s, "general", 25)
+	s.Close()
+
+	s, err = newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testPaging(t, s)
+}
+
+func TestFileStoreLogNames(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Channel names come from users, so they mustn't be able to escape the
+	// store's directory.
+	fill(t, s, "../escape", 1)
+	s.Close()
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); err == nil {
+		t.Fatal("a log was written outside the store's directory")
+	}
+
+	s, err = newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seq, _ := s.LastSeq("../escape"); seq != 1 {
+		t.Fatalf("LastSeq: got %d, want 1", seq)
+	}
+}
+
+func TestFileStoreScrubsDeletedText(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMessage("general", "rob", "my password is hunter2", text)
+	m.ID, m.Seq = 1, 1
+	s.Append(m)
+	s.Append(&Message{Channel: "general", Username: "rob", Text: "my password is hunter3", MessageType: edit, Target: 1})
+	keep := newMessage("general", "ana", "hunter2 is a bad password", text)
+	keep.ID, keep.Seq = 2, 2
+	s.Append(keep)
+	if err := s.Append(&Message{Channel: "general", Username: "rob", MessageType: remove, Target: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest segment is still open, and appending to it still works.
+	last := newMessage("general", "rob", "oops", text)
+	last.ID, last.Seq = 3, 3
+	if err := s.Append(last); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	b, err := os.ReadFile(segmentPath(s.logDir("general"), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "my password") {
+		t.Fatalf("deleted text is still on disk:\n%s", b)
+	}
+	if !strings.Contains(string(b), "hunter2 is a bad password") || !strings.Contains(string(b), "oops") {
+		t.Fatalf("other messages were lost:\n%s", b)
+	}
+
+	s, err = newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if m, _ := s.Message(1); m.Text != "" || !m.Deleted {
+		t.Fatalf("got %+v after reloading", m)
+	}
+	if seq, _ := s.LastSeq("general"); seq != 3 {
+		t.Fatalf("LastSeq: got %d, want 3", seq)
+	}
+}
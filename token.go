@@ -0,0 +1,420 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A scope is something an API token can be used for.
+type scope string
+
+const (
+	// scopePost lets a token send messages, and change or react to them.
+	scopePost scope = "post"
+	// scopeRead lets a token read the history of the channels it's for,
+	// even if they're private.
+	scopeRead scope = "read"
+	// scopeManage lets a token send any other kind of message, including
+	// commands.
+	scopeManage scope = "manage"
+)
+
+// parseScopes parses a comma separated list of scopes, like "post,read".
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, name := range strings.Split(s, ",") {
+		switch sc := scope(strings.TrimSpace(name)); sc {
+		case scopePost, scopeRead, scopeManage:
+			scopes = append(scopes, string(sc))
+		default:
+			return nil, errors.New("scopes can be post, read or manage")
+		}
+	}
+	return scopes, nil
+}
+
+// An apiToken lets a program use the API as Name, but only to do the things
+// in Scopes, and only in Channels if there are any. Only a hash of the token
+// is kept, so it can't be recovered from the file it's saved in.
+type apiToken struct {
+	ID       string
+	Hash     string
+	Name     string
+	Scopes   []string
+	Channels []string `json:",omitempty"`
+	By       string
+	Created  time.Time
+}
+
+// A tokenStore holds every API token, saving them to disk whenever they
+// change. It's checked by the API, so it's safe to use from multiple
+// goroutines.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*apiToken
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{
+		path:   path,
+		tokens: make(map[string]*apiToken),
+	}
+	var tokens []*apiToken
+	if err := loadJSON(path, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issue creates a token, returning it along with the secret that's used to
+// authenticate with it. The secret is only ever available here.
+func (s *tokenStore) issue(name string, scopes, channels []string, by string) (*apiToken, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := "chat_" + base64.RawURLEncoding.EncodeToString(b)
+	t := &apiToken{
+		Hash:     hashToken(secret),
+		Name:     name,
+		Scopes:   scopes,
+		Channels: channels,
+		By:       by,
+		Created:  time.Now(),
+	}
+	t.ID = t.Hash[:12]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	return t, secret, s.save()
+}
+
+// lookup returns the token the secret belongs to, if there is one.
+func (s *tokenStore) lookup(secret string) *apiToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[hashToken(secret)]
+}
+
+// revoke deletes the token with the given ID, reporting whether there was
+// one.
+func (s *tokenStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.tokens {
+		if t.ID == id {
+			delete(s.tokens, hash)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+// list returns every token, oldest first.
+func (s *tokenStore) list() []*apiToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]*apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+// save writes every token to disk. The caller must hold the lock.
+func (s *tokenStore) save() error {
+	tokens := make([]*apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return saveJSON(s.path, tokens)
+}
+
+// A credential is who an API request is from, and what it's allowed to do.
+// Requests made with an account's password can do anything that account
+// can, and ones made with a token are limited to its scopes and channels.
+type credential struct {
+	name     string
+	account  bool
+	token    string
+	scopes   map[scope]bool
+	channels map[string]bool
+}
+
+func (c *credential) allows(s scope) bool {
+	return c.account || c.scopes[s]
+}
+
+// allowsChannel reports whether the credential can be used in the named
+// channel.
+func (c *credential) allowsChannel(name string) bool {
+	return c.channels == nil || c.channels[name]
+}
+
+// scopeFor returns the scope needed to send a message of type t through the
+// API.
+func scopeFor(t MessageType) scope {
+	switch t {
+	case text, dm, edit, remove, react, unreact:
+		return scopePost
+	case markRead:
+		return scopeRead
+	}
+	return scopeManage
+}
+
+type credentialKey struct{}
+
+// credentialFrom returns the credential a request was authorized with, or
+// nil if it didn't have one.
+func credentialFrom(r *http.Request) *credential {
+	c, _ := r.Context().Value(credentialKey{}).(*credential)
+	return c
+}
+
+// credential returns the credential the request authenticates with, either
+// an API token as a bearer token, or an account's name and password with
+// basic auth. It returns nil if the request doesn't try to authenticate,
+// and an error if it does, but gets it wrong.
+func (h *hub) credential(r *http.Request) (*credential, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		t := h.tokens.lookup(strings.TrimPrefix(auth, "Bearer "))
+		if t == nil {
+			return nil, errors.New("That token isn't valid.")
+		}
+		c := &credential{name: t.Name, token: t.ID, scopes: make(map[scope]bool)}
+		for _, s := range t.Scopes {
+			c.scopes[scope(s)] = true
+		}
+		if len(t.Channels) > 0 {
+			c.channels = make(map[string]bool)
+			for _, name := range t.Channels {
+				c.channels[name] = true
+			}
+		}
+		return c, nil
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	if !h.allowLogin(hostOf(r.RemoteAddr)) {
+		return nil, errTooManyLogins
+	}
+	if err := h.accounts.authenticate(name, password); err != nil {
+		return nil, errors.New("Wrong name or password.")
+	}
+	return &credential{name: name, account: true}, nil
+}
+
+// authorized wraps next so it's only called for requests that have a
+// credential allowing s. When optional is true, requests without any
+// credential, or without s, are let through too, and next decides what
+// they can see.
+func authorized(s scope, optional bool, next handler) handler {
+	return func(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		c, err := h.credential(r)
+		if err == errTooManyLogins {
+			http.Error(w, "Too many login attempts. Try again later.", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chat"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if c == nil {
+			if optional {
+				next(h, w, r, ps)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="chat"`)
+			http.Error(w, "You need to log in to a registered account, or use an API token.", http.StatusUnauthorized)
+			return
+		}
+		if b := h.bans.nameBanned(c.name); b != nil {
+			http.Error(w, "You're banned from this server.", http.StatusForbidden)
+			return
+		}
+		if !c.allows(s) && !optional {
+			http.Error(w, "You aren't allowed to "+string(s)+" with that token.", http.StatusForbidden)
+			return
+		}
+		next(h, w, r.WithContext(context.WithValue(r.Context(), credentialKey{}, c)), ps)
+	}
+}
+
+// adminOnly wraps next so it's only called for admins, logged in with their
+// account's password.
+func adminOnly(next handler) handler {
+	return authorized(scopeManage, false, func(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if c := credentialFrom(r); !c.account || h.roleFor(c.name) < roleAdmin {
+			http.Error(w, "Only admins can do that.", http.StatusForbidden)
+			return
+		}
+		next(h, w, r, ps)
+	})
+}
+
+// A tokenRequest asks for a token to be issued through the API.
+type tokenRequest struct {
+	Name     string
+	Scopes   []string
+	Channels []string
+}
+
+// An issuedToken is a newly issued token, along with the secret to use it
+// with, as returned by the API.
+type issuedToken struct {
+	*apiToken
+	Token string
+}
+
+func tokensHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.tokens.list())
+}
+
+func newTokenHandler(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := &tokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	scopes, err := parseScopes(strings.Join(req.Scopes, ","))
+	if err != nil || req.Name == "" {
+		http.Error(w, "A token needs a Name, and Scopes that are post, read or manage.", http.StatusBadRequest)
+		return
+	}
+	t, secret, err := h.tokens.issue(req.Name, scopes, req.Channels, credentialFrom(r).name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.logger.Printf("(%s issued token %s for %s)", t.By, t.ID, t.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&issuedToken{apiToken: t, Token: secret})
+}
+
+func revokeTokenHandler(h *hub, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ok, err := h.tokens.revoke(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.logger.Printf("(%s revoked token %s)", credentialFrom(r).name, ps.ByName("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueToken issues a token for an admin. The text of the message is the
+// name the token acts as, its scopes, and optionally the channels it can be
+// used in.
+func (h *hub) issueToken(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.authorize(user, permAdmin) {
+		user.conn.write(newMessage("you", "server", "Only admins can do that.\n", text))
+		return
+	}
+	args := strings.Fields(m.Text)
+	if len(args) < 2 {
+		user.conn.write(newMessage("you", "server", "A token needs a name to act as, and scopes, like /token ci post,read builds.\n", text))
+		return
+	}
+	scopes, err := parseScopes(args[1])
+	if err != nil {
+		user.conn.write(newMessage("you", "server", "Couldn't issue a token: "+err.Error()+".\n", text))
+		return
+	}
+	t, secret, err := h.tokens.issue(args[0], scopes, args[2:], user.name)
+	if err != nil {
+		h.logger.Println("Unable to save tokens:", err.Error())
+		user.conn.write(newMessage("you", "server", "Couldn't issue a token right now.\n", text))
+		return
+	}
+	h.logger.Printf("(%s issued token %s for %s)", user.name, t.ID, t.Name)
+	user.conn.write(newMessage("you", "server", "Issued token "+t.ID+" for "+t.Name+". Keep it somewhere safe, since it won't be shown again: "+secret+"\n", text))
+}
+
+// listTokens tells an admin about every token.
+func (h *hub) listTokens(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.authorize(user, permAdmin) {
+		user.conn.write(newMessage("you", "server", "Only admins can do that.\n", text))
+		return
+	}
+	tokens := h.tokens.list()
+	if len(tokens) == 0 {
+		user.conn.write(newMessage("you", "server", "There aren't any tokens.\n", text))
+		return
+	}
+	lines := []string{"Tokens:"}
+	for _, t := range tokens {
+		line := "  " + t.ID + " for " + t.Name + " (" + strings.Join(t.Scopes, ",") + ")"
+		if len(t.Channels) > 0 {
+			line += " in " + strings.Join(t.Channels, ", ")
+		}
+		lines = append(lines, line+", issued by "+t.By)
+	}
+	user.conn.write(newMessage("you", "server", strings.Join(lines, "\n")+"\n", text))
+}
+
+// revokeToken revokes a token for an admin. The text of the message is the
+// token's ID.
+func (h *hub) revokeToken(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	if !h.authorize(user, permAdmin) {
+		user.conn.write(newMessage("you", "server", "Only admins can do that.\n", text))
+		return
+	}
+	id := strings.TrimSpace(m.Text)
+	ok, err := h.tokens.revoke(id)
+	if err != nil {
+		h.logger.Println("Unable to save tokens:", err.Error())
+	}
+	if !ok {
+		user.conn.write(newMessage("you", "server", "There's no token "+id+".\n", text))
+		return
+	}
+	h.logger.Printf("(%s revoked token %s)", user.name, id)
+	user.conn.write(newMessage("you", "server", "Revoked token "+id+".\n", text))
+}
@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// typingThrottle is how often someone typing is passed on to everyone
+	// else. Clients can say they're typing with every keystroke, but most
+	// of those are dropped.
+	typingThrottle = 3 * time.Second
+
+	// typingTimeout is how long someone is shown as typing after the last
+	// time their client said they were.
+	typingTimeout = 6 * time.Second
+
+	// The text of a typing message says whether someone started or stopped.
+	typingStarted = "start"
+	typingStopped = "stop"
+)
+
+// A typingKey is someone typing in a channel, or to someone else, in which
+// case the target is their name with an @ in front of it.
+type typingKey struct {
+	user   *User
+	target string
+}
+
+// A typingState is when someone typing was last passed on, and when they'll
+// be shown as having stopped if their client doesn't say otherwise.
+type typingState struct {
+	relayed time.Time
+	expires time.Time
+}
+
+// typing passes on that a user has started or stopped typing, to whoever
+// else is connected over a websocket and can see what they're typing in.
+// The channel of the message is where they're typing, and its text is
+// typingStopped once they've stopped.
+func (h *hub) typing(m *Message) {
+	user, ok := h.sender(m)
+	if !ok {
+		return
+	}
+	// Only somewhere the user could send a message to is kept track of.
+	if strings.HasPrefix(m.Channel, "@") {
+		if _, ok := h.users[strings.TrimPrefix(m.Channel, "@")]; !ok || !h.authorize(user, permDM) {
+			return
+		}
+	} else if ch, ok := h.channels[m.Channel]; !ok || !ch.users[user] {
+		return
+	}
+	key := typingKey{user, m.Channel}
+	now := time.Now()
+	if m.Text == typingStopped {
+		if _, ok := h.typists[key]; ok {
+			delete(h.typists, key)
+			h.relayTyping(user, m.Channel, typingStopped)
+		}
+		return
+	}
+	st, ok := h.typists[key]
+	if !ok {
+		st = &typingState{}
+		h.typists[key] = st
+	}
+	st.expires = now.Add(typingTimeout)
+	if now.Sub(st.relayed) < typingThrottle {
+		return
+	}
+	st.relayed = now
+	h.relayTyping(user, m.Channel, typingStarted)
+}
+
+// stopTyping forgets that u was typing in target, without telling anyone,
+// because they just sent what they were typing.
+func (h *hub) stopTyping(u *User, target string) {
+	delete(h.typists, typingKey{u, target})
+}
+
+// expireTyping tells everyone that people whose clients haven't said they're
+// typing in a while have stopped.
+func (h *hub) expireTyping(now time.Time) {
+	for key, st := range h.typists {
+		if now.Before(st.expires) {
+			continue
+		}
+		delete(h.typists, key)
+		if h.users[key.user.name] == key.user {
+			h.relayTyping(key.user, key.target, typingStopped)
+		}
+	}
+}
+
+// relayTyping sends a typing message for u to the websocket users who can
+// see target. Everyone else would only find them noisy.
+func (h *hub) relayTyping(u *User, target, state string) {
+	m := newMessage(target, u.name, state, typing)
+	if strings.HasPrefix(target, "@") {
+		recipient, ok := h.users[strings.TrimPrefix(target, "@")]
+		if ok && recipient.transport == transportWS && !h.ignores.blocking(recipient.name, u.name) {
+			recipient.conn.write(m)
+		}
+		return
+	}
+	ch, ok := h.channels[target]
+	if !ok || !ch.users[u] {
+		return
+	}
+	for member := range ch.users {
+		if member != u && member.transport == transportWS {
+			member.conn.write(m)
+		}
+	}
+}
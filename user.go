@@ -1,15 +1,17 @@
 package chat
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type connection interface {
 	read() error
-	write(message *message) error
+	write(message *Message) error
 	close()
 }
 
@@ -17,27 +19,130 @@ type connection interface {
 // communicate
 type User struct {
 	name string
-	conn connection
+	// account is the name of the account the user logged in to, or empty
+	// if they didn't.
+	account string
+	role    role
+	addr    string
+	conn    connection
+
+	// transport is how the user is connected, like TCP or WS.
+	transport  string
+	connected  time.Time
+	lastActive time.Time
+
+	// presence is whether the user is away, and awayMessage is what people
+	// who send them direct messages are told. awayReplied holds who's been
+	// told already.
+	presence    presence
+	awayMessage string
+	awayReplied map[string]bool
+
+	// credential is what an API session authenticated with. It's nil for
+	// users who are connected.
+	credential *credential
+
+	// sent holds the IDs of the messages a guest has sent since they
+	// connected, which are the only ones they can change.
+	sent map[uint64]bool
+}
+
+// id is what the user's standing in channels, like being an operator, is
+// kept under. It's their account if they logged in to one, since nobody else
+// can use that, and otherwise it's their name, which only lasts until they
+// leave.
+func (u *User) id() string {
+	if u.account != "" {
+		return u.account
+	}
+	return u.name
+}
+
+// author is what messages sent by u are credited to, so they can be
+// recognized as theirs later. It's their account, or the API token they
+// used, and empty for guests.
+func (u *User) author() string {
+	if u.account != "" {
+		return u.account
+	}
+	if u.credential != nil && u.credential.token != "" {
+		return "token " + u.credential.token
+	}
+	return ""
+}
+
+// wrote reports whether u sent m. Messages from guests are only theirs for
+// as long as they're connected.
+func (u *User) wrote(m *Message) bool {
+	if m.Author != "" {
+		return m.Author == u.author()
+	}
+	return u.sent[m.ID]
+}
+
+// mayUse reports whether u can do anything in the named channel. Only API
+// sessions with a token limited to other channels can't.
+func (u *User) mayUse(name string) bool {
+	return u.credential == nil || u.credential.allowsChannel(name)
 }
 
 func createTCPUser(conn net.Conn, h *hub) *User {
-	u := newTCPUser(conn, h)
-	u.write(newMessage(u.currentRoomName, u.username, chatHelp, text))
+	u, err := newTCPUser(conn, h)
+	if err != nil {
+		return nil
+	}
+	transport := transportTCP
+	if _, ok := conn.(*tls.Conn); ok {
+		transport = transportTLS
+	}
 	return &User{
-		name: u.name(),
-		conn: u,
+		name:      u.name(),
+		account:   u.account,
+		addr:      hostOf(conn.RemoteAddr().String()),
+		conn:      u,
+		transport: transport,
 	}
 }
 
 func createWSUser(h *hub, w http.ResponseWriter, r *http.Request, _ httprouter.Params) *User {
 	u, err := newWsUser(w, r, h)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), handshakeStatus(err))
 		return nil
 	}
-	u.write(newMessage(u.currentRoomName, u.username, chatHelp, text))
 	return &User{
-		name: u.username,
-		conn: u,
+		name:      u.username,
+		account:   u.account,
+		addr:      hostOf(r.RemoteAddr),
+		conn:      u,
+		transport: transportWS,
+	}
+}
+
+// handshakeStatus returns the HTTP status to answer a websocket handshake
+// that failed with err. Only problems with the server itself are its fault.
+func handshakeStatus(err error) int {
+	if ce, ok := err.(*clientError); ok {
+		return ce.status
+	}
+	switch err {
+	case errWrongPassword, errLoginRequired:
+		return http.StatusUnauthorized
+	case errTooManyLogins:
+		return http.StatusTooManyRequests
+	case errPasswordTooShort:
+		return http.StatusBadRequest
+	case errNameNotAvailable, errNameReserved, errAccountExists:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// hostOf returns the host part of a network address, without its port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
+	return host
 }
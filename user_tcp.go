@@ -3,282 +3,379 @@ package chat
 import (
 	"bufio"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-const chatHelp = `Hello, welcome to the chat server!
-Commands:
-  /help       see this help message again    (example: /help)
-  /listusers  see all users connected        (example: /listusers)
-  /listrooms  see all channels               (example: /listrooms)
-  /newroom    create a new room and join it  (example: /newroom random)
-  /join       join a room                    (example: /join random)
-  /leave      leave a room                   (example: /leave random)
-  /mute       mute a user                    (example: /mute rob)
-  /unmute     unmute a user                  (example: /unmute rob)
-  /mutes      see who you've muted           (example: /mutes)
-  /dm         send a message to a user       (example: /dm rob: hello!)
-`
-
-type command func(tc *tcpUser, arg string)
-
-// commands are each action a client is able to perform besides just sending
-// plaintext.
-var commands = map[string]command{
-	"/help":      helpCmd,
-	"/listusers": listUsersCmd,
-	"/listrooms": listRoomsCmd,
-	"/newroom":   newRoomCmd,
-	"/join":      joinRoomCmd,
-	"/leave":     leaveRoomCmd,
-	"/mute":      muteCmd,
-	"/unmute":    unmuteCmd,
-	"/mutes":     mutesCmd,
-	"/dm":        dmCmd,
-}
-
 // a tcpUser represents a telnet user, relying on text-only commands to
 // communicate.
 type tcpUser struct {
+	// mu guards the user's name and current room, which are changed by
+	// what the hub writes to them, and read while sending what they type.
+	mu              sync.Mutex
 	currentRoomName string
-	muted           map[string]bool
 	username        string
+	account         string
 	r               *bufio.Reader
 	conn            net.Conn
-	send            chan<- *message
+	send            chan<- *Message
 }
 
-func newTCPUser(conn net.Conn, h *hub) *tcpUser {
-	var name string
-	r := bufio.NewReader(conn)
+// Telnet commands, used to stop the client from echoing passwords.
+const (
+	telnetIAC  = 255
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetEcho = 1
+)
+
+func newTCPUser(conn net.Conn, h *hub) (*tcpUser, error) {
+	tc := &tcpUser{
+		currentRoomName: defaultChannelName,
+		r:               bufio.NewReader(conn),
+		conn:            conn,
+		send:            h.messageCh,
+	}
 	conn.Write([]byte("Please enter your username: "))
 
 	for {
-		n, err := r.ReadString('\n')
+		n, err := tc.readLine()
 		if err != nil {
 			conn.Close()
+			return nil, err
 		}
 		n = strings.TrimSpace(n)
-		if n == "" {
-			conn.Write([]byte("Your name cannot be blank. Try again: "))
+		if err := checkName(n); err != nil {
+			conn.Write([]byte(err.Error() + " Try again: "))
+			continue
+		}
+		if b := h.bans.nameBanned(n); b != nil {
+			conn.Write([]byte("Sorry, the name " + n + " is banned. Please choose another one: "))
 			continue
 		}
-		if _, ok := h.users[n]; !ok {
-			name = n
-			break
+		if !h.nameAvailable(n) {
+			conn.Write([]byte("Sorry, the name " + n + " is already taken. Please choose another one: "))
+			continue
+		}
+
+		var ok bool
+		switch {
+		case h.accounts.exists(n):
+			ok, err = tc.login(h, n)
+		case h.cfg.RequireLogin:
+			ok, err = tc.registerAccount(h, n)
+		default:
+			tc.username = n
+			return tc, nil
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
 		}
-		conn.Write([]byte("Sorry, the name " + n + " is already taken. Please choose another one: "))
-		continue
+		if ok {
+			tc.username, tc.account = n, n
+			return tc, nil
+		}
+		conn.Write([]byte("Please enter your username: "))
 	}
+}
 
-	return &tcpUser{
-		currentRoomName: defaultChannelName,
-		muted:           make(map[string]bool),
-		username:        name,
-		r:               bufio.NewReader(conn),
-		conn:            conn,
-		send:            h.messageCh,
+// login asks for the password of the named account. It reports whether the
+// right one was given, and gives up on the connection after too many wrong
+// ones.
+func (tc *tcpUser) login(h *hub, name string) (bool, error) {
+	for i := 0; i < maxLoginAttempts; i++ {
+		password, err := tc.readPassword("Password for " + name + ": ")
+		if err != nil {
+			return false, err
+		}
+		if password == "" {
+			return false, nil
+		}
+		if !h.allowLogin(hostOf(tc.conn.RemoteAddr().String())) {
+			tc.writeText("Too many login attempts. Try again later.\n")
+			return false, errTooManyLogins
+		}
+		err = h.accounts.authenticate(name, password)
+		if err == nil {
+			return true, nil
+		}
+		if err != errWrongPassword {
+			return false, err
+		}
+		tc.writeText("Wrong password.\n")
+	}
+	tc.writeText("Too many wrong passwords. Goodbye.\n")
+	return false, errWrongPassword
+}
+
+// registerAccount offers to register the named account, for servers where
+// everyone has to log in. It reports whether the account was registered.
+func (tc *tcpUser) registerAccount(h *hub, name string) (bool, error) {
+	tc.writeText("There's no account called " + name + ", and you need one to join. ")
+	for {
+		password, err := tc.newPassword()
+		if err != nil || password == "" {
+			return false, err
+		}
+		if !h.allowLogin(hostOf(tc.conn.RemoteAddr().String())) {
+			tc.writeText("Too many login attempts. Try again later.\n")
+			return false, errTooManyLogins
+		}
+		err = h.accounts.register(name, password)
+		if err == nil {
+			return true, nil
+		}
+		tc.writeText("Couldn't register " + name + ": " + err.Error() + ".\n")
+		if err == errAccountExists || err == errNameReserved {
+			return false, nil
+		}
+	}
+}
+
+// newPassword asks for a password to register, twice to make sure it was
+// typed correctly. An empty password means they've changed their mind.
+func (tc *tcpUser) newPassword() (string, error) {
+	for {
+		password, err := tc.readPassword("Choose a password, or just press enter to cancel: ")
+		if err != nil || password == "" {
+			return "", err
+		}
+		again, err := tc.readPassword("Type it again: ")
+		if err != nil {
+			return "", err
+		}
+		if again == password {
+			return password, nil
+		}
+		tc.writeText("Those passwords don't match.\n")
 	}
 }
 
+// readPassword prompts for a password, asking the client not to echo it
+// while it's typed.
+func (tc *tcpUser) readPassword(prompt string) (string, error) {
+	tc.conn.Write([]byte{telnetIAC, telnetWill, telnetEcho})
+	tc.writeText(prompt)
+	password, err := tc.readLine()
+	tc.conn.Write([]byte{telnetIAC, telnetWont, telnetEcho})
+	tc.writeText("\r\n")
+	return strings.TrimRight(password, "\r\n"), err
+}
+
+// readLine reads a line of input, leaving out any telnet commands, like the
+// client agreeing to stop echoing.
+func (tc *tcpUser) readLine() (string, error) {
+	line, err := tc.r.ReadString('\n')
+	if strings.IndexByte(line, telnetIAC) == -1 {
+		return line, err
+	}
+	b := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] != telnetIAC:
+			b = append(b, line[i])
+		case i+1 < len(line) && line[i+1] == telnetIAC:
+			b = append(b, telnetIAC)
+			i++
+		case i+1 < len(line) && line[i+1] >= telnetWill && line[i+1] <= telnetDont:
+			// These are followed by the option they're about.
+			i += 2
+		default:
+			i++
+		}
+	}
+	return string(b), err
+}
+
 func (tc *tcpUser) read() error {
 	for {
-		messageText, err := tc.r.ReadString('\n')
+		messageText, err := tc.readLine()
 		if err != nil {
-			tc.send <- newMessage("everyone", tc.username, tc.username+" has left that chat\n", quit)
+			tc.post(newMessage("everyone", tc.name(), tc.name()+" has left that chat\n", quit))
 			return err
 		}
+		// Passwords are asked for here, rather than typed after the
+		// command, so they aren't echoed.
+		if strings.TrimSpace(messageText) == "/register" {
+			password, err := tc.newPassword()
+			if err != nil {
+				tc.post(newMessage("everyone", tc.name(), tc.name()+" has left that chat\n", quit))
+				return err
+			}
+			if password != "" {
+				tc.post(newMessage("", tc.name(), password, register))
+			}
+			continue
+		}
 		if ok := tc.handleCommand(messageText); ok {
 			continue
 		}
-		tc.send <- newMessage(tc.currentRoomName, tc.username, messageText, text)
+		tc.post(newMessage(tc.room(), tc.name(), messageText, text))
 	}
 }
 
-func (tc *tcpUser) write(message *message) error {
-	if _, ok := tc.muted[message.Username]; ok {
-		return nil
-	}
+// post sends m to the hub, stamped with the name this connection logged in
+// as.
+func (tc *tcpUser) post(m *Message) {
+	m.from = tc.name()
+	tc.send <- m
+}
+
+func (tc *tcpUser) write(message *Message) error {
 	switch message.MessageType {
 	case text:
-		return tc.writeText("(" + message.Username + " to " + message.Channel + "): " + message.Text)
+		return tc.writeText(prefix(message) + message.Text)
 
-	case listUsers, listChannels:
+	case listUsers, listChannels, listMutes:
 		return tc.writeText(message.Text + "\n")
 
 	case join, create:
-		tc.currentRoomName = message.Channel
+		// Other users joining a room we're in shouldn't move us into it.
+		tc.mu.Lock()
+		if message.Username == tc.username {
+			tc.currentRoomName = message.Channel
+		}
+		tc.mu.Unlock()
+		return tc.writeText(message.Text)
+
+	case nick:
+		tc.mu.Lock()
+		if message.Username == tc.username {
+			tc.username = message.Channel
+		}
+		tc.mu.Unlock()
 		return tc.writeText(message.Text)
 
 	case leave:
+		tc.mu.Lock()
 		tc.currentRoomName = defaultChannelName
+		tc.mu.Unlock()
 		return tc.writeText(message.Text)
 
-	case mute:
-		if _, ok := tc.muted[message.Channel]; !ok {
-			tc.muted[message.Channel] = true
-			return tc.writeText(message.Text)
-		}
-		return tc.writeText("User " + message.Channel + " is already muted.\n")
-
-	case unmute:
-		if _, ok := tc.muted[message.Channel]; ok {
-			delete(tc.muted, message.Channel)
-			return tc.writeText(message.Text)
-		}
-		return tc.writeText("User " + message.Channel + " isn't muted.\n")
+	case mute, unmute, block, unblock:
+		return tc.writeText(message.Text)
 
 	case dm:
-		tc.writeText("(" + message.Username + " to " + message.Channel + "): " + message.Text + "\n")
-	}
-	return nil
-}
+		tc.writeText(prefix(message) + message.Text + "\n")
 
-func (tc *tcpUser) writeText(text string) error {
-	_, err := tc.conn.Write([]byte(text))
-	if err != nil {
-		return err
-	}
-	return nil
-}
+	case history:
+		return tc.writeText(tc.formatHistory(message))
 
-func (tc *tcpUser) close() {
-	tc.conn.Close()
-}
+	case edit:
+		return tc.writeText("(" + message.Username + " edited #" + strconv.FormatUint(message.Target, 10) + " in " + message.Channel + "): " + strings.TrimRight(message.Text, "\n") + " (edited)\n")
 
-func (tc *tcpUser) name() string {
-	return tc.username
-}
+	case remove:
+		return tc.writeText("(" + message.Username + " deleted #" + strconv.FormatUint(message.Target, 10) + " in " + message.Channel + ")\n")
 
-func (tc *tcpUser) handleCommand(s string) bool {
-	if !strings.HasPrefix(s, "/") {
-		return false
-	}
-	cmd := strings.TrimSpace(strings.Split(s, " ")[0])
-	cmdFunc, ok := commands[cmd]
-	if !ok {
-		tc.write(newMessage(tc.currentRoomName, tc.username, "Command "+cmd+" doesn't exist\n", text))
-		return true
-	}
-	cmdArg := strings.TrimSpace(strings.TrimPrefix(s, cmd))
-	cmdFunc(tc, cmdArg)
-	return true
-}
+	case react:
+		return tc.writeText(message.Username + " reacted " + message.Text + " to #" + strconv.FormatUint(message.Target, 10) + "\n")
 
-func helpCmd(tc *tcpUser, _ string) {
-	tc.write(newMessage("you", "server", chatHelp, text))
-}
+	case unreact:
+		return tc.writeText(message.Username + " took back " + message.Text + " on #" + strconv.FormatUint(message.Target, 10) + "\n")
 
-func newRoomCmd(tc *tcpUser, arg string) {
-	arg = strings.TrimSpace(arg)
-	if arg == "" {
-		tc.write(newMessage("you", "server", "Room name cannot be blank\n", text))
-		return
-	}
-	if arg == tc.currentRoomName {
-		tc.write(newMessage("you", "server", "You're already in that room\n", text))
-		return
+	case topic:
+		if message.Text == "" {
+			return tc.writeText("There's no topic set for " + message.Channel + ".\n")
+		}
+		return tc.writeText("Topic for " + message.Channel + ": " + message.Text + " (set by " + message.Username + ", " + message.Time.Format("Jan 2 15:04") + ")\n")
 	}
-	tc.send <- newMessage(arg, tc.username, tc.username+" created new channel "+arg, create)
+	return nil
 }
 
-func joinRoomCmd(tc *tcpUser, arg string) {
-	arg = strings.TrimSpace(arg)
-	if arg == "" {
-		tc.write(newMessage("you", "server", "Room name cannot be blank\n", text))
-		return
+// formatHistory renders the messages replayed by a history message.
+func (tc *tcpUser) formatHistory(message *Message) string {
+	var b strings.Builder
+	if len(message.History) == 0 {
+		return "There are no more messages in " + message.Channel + ".\n"
 	}
-	if arg == tc.currentRoomName {
-		tc.write(newMessage("you", "server", "You're already in that room\n", text))
-		return
+	b.WriteString("--- Messages in " + message.Channel + " ---\n")
+	for _, m := range message.History {
+		b.WriteString("[" + m.Time.Format("Jan 2 15:04") + "] " + prefix(m))
+		switch {
+		case m.Deleted:
+			b.WriteString("(deleted)")
+		case m.Edited:
+			b.WriteString(strings.TrimRight(m.Text, "\n") + " (edited)")
+		default:
+			b.WriteString(strings.TrimRight(m.Text, "\n"))
+		}
+		b.WriteString(formatReactions(m.Reactions) + "\n")
 	}
-	tc.send <- newMessage(arg, tc.username, tc.username+" joined channel "+arg, join)
-}
-
-func leaveRoomCmd(tc *tcpUser, arg string) {
-	arg = strings.TrimSpace(arg)
-	if arg == "" {
-		tc.write(newMessage("you", "server", "Room name cannot be blank\n", text))
+	if message.Cursor > 0 {
+		n := strconv.Itoa(len(message.History))
+		b.WriteString("--- For older messages, type /history " + message.Channel + " " + n + " " + strconv.FormatUint(message.Cursor, 10) + " ---\n")
+		return b.String()
 	}
-	tc.send <- newMessage(arg, tc.username, tc.username+" joined channel "+arg, leave)
+	b.WriteString("--- Start of " + message.Channel + " ---\n")
+	return b.String()
 }
 
-func muteCmd(tc *tcpUser, arg string) {
-	arg = strings.TrimSpace(arg)
-	if arg == "" {
-		tc.writeText("Username cannot be blank\n")
-		return
+// formatReactions summarises the reactions to a message, like
+// " [:+1: 2, :tada: 1]".
+func formatReactions(reactions map[string][]string) string {
+	if len(reactions) == 0 {
+		return ""
 	}
-	if arg == tc.username {
-		tc.writeText("You can't mute yourself\n")
-		return
+	var rs []string
+	for r := range reactions {
+		rs = append(rs, r)
 	}
-
-	tc.send <- newMessage(arg, tc.username, "Muted user "+arg+".\n", mute)
-}
-
-func unmuteCmd(tc *tcpUser, arg string) {
-	arg = strings.TrimSpace(arg)
-	if arg == "" {
-		tc.writeText("Username cannot be blank\n")
-		return
+	sort.Strings(rs)
+	for i, r := range rs {
+		rs[i] = r + " " + strconv.Itoa(len(reactions[r]))
 	}
-	tc.send <- newMessage(arg, tc.username, "Unmuted user "+arg+".\n", unmute)
+	return " [" + strings.Join(rs, ", ") + "]"
 }
 
-func mutesCmd(tc *tcpUser, _ string) {
-	if len(tc.muted) < 1 {
-		tc.writeText("You haven't muted anyone.\n")
-		return
+// prefix returns the text shown before a message to say who it's from and
+// where it was sent, along with its ID if it has one, so it can be referred
+// to later.
+func prefix(m *Message) string {
+	p := "(" + m.Username + " to " + m.Channel + "): "
+	if m.ReplyTo > 0 {
+		p = "(" + m.Username + " to " + m.Channel + ", re #" + strconv.FormatUint(m.ReplyTo, 10) + "): "
 	}
-	var mutes []string
-	for mute := range tc.muted {
-		mutes = append(mutes, mute)
+	if m.ID > 0 {
+		p = "#" + strconv.FormatUint(m.ID, 10) + " " + p
 	}
-	muteList := strings.Join(mutes, "\n  - ")
-	tc.writeText("You've muted:\n  - " + muteList + "\n")
+	return p
 }
 
-func dmCmd(tc *tcpUser, arg string) {
-	i := strings.Index(arg, ":")
-	if i == -1 {
-		tc.writeText("/dm command not understood, you're missing a ':' from your command.\n")
-		return
-	}
-	msgs := strings.SplitAfterN(arg, ":", 2)
-	// sanity check, SplitAfterN should always return a length 2 slice
-	if len(msgs) < 2 {
-		tc.writeText("/dm command not understood, commands appears to be malformed. Type '/help' to see how to use each command.\n")
-		return
-	}
-
-	user := strings.TrimSpace(strings.TrimRight(msgs[0], ":"))
-	if user == "" {
-		tc.writeText("/dm command not understood, you're missing a username.\n")
-		return
+func (tc *tcpUser) writeText(text string) error {
+	_, err := tc.conn.Write([]byte(text))
+	if err != nil {
+		return err
 	}
+	return nil
+}
 
-	if user == tc.username {
-		tc.writeText("You can't send a dm to yourself.\n")
-		return
-	}
+func (tc *tcpUser) close() {
+	tc.conn.Close()
+}
 
-	msg := strings.TrimSpace(msgs[1])
-	if msg == "" {
-		tc.writeText("/dm command not understood, it looks like your message is blank.\n")
-		return
-	}
-	tc.send <- (newMessage(user, tc.username, msg, dm))
+func (tc *tcpUser) name() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.username
 }
 
-func listUsersCmd(tc *tcpUser, arg string) {
-	if arg != "" {
-		tc.send <- newMessage(arg, tc.username, "", listUsers)
-		return
-	}
-	tc.send <- newMessage("", tc.username, "", listUsers)
+// room returns the room that what the user types is sent to.
+func (tc *tcpUser) room() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.currentRoomName
 }
 
-func listRoomsCmd(tc *tcpUser, _ string) {
-	tc.send <- newMessage("", tc.username, "", listChannels)
+// handleCommand sends s to the hub as a command, if it is one.
+func (tc *tcpUser) handleCommand(s string) bool {
+	if !strings.HasPrefix(s, "/") {
+		return false
+	}
+	tc.post(newMessage(tc.room(), tc.name(), strings.TrimSpace(s), command))
+	return true
 }
@@ -4,34 +4,77 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
-var errNameNotAvailable = errors.New("That name is not available")
+var (
+	errNameNotAvailable = errors.New("That name is not available")
+	errLoginRequired    = errors.New("You need to log in to a registered account")
+)
+
+// A clientError is a websocket handshake that failed because of what the
+// client sent, and has the HTTP status to answer it with.
+type clientError struct {
+	status int
+	msg    string
+}
+
+func (e *clientError) Error() string { return e.msg }
 
 // A wsUser represents a client connected via a websocket.
 type wsUser struct {
+	// mu guards the user's name, which is changed by what the hub writes
+	// to them, and read while sending what they send.
+	mu              sync.Mutex
 	currentRoomName string
-	muted           map[string]bool
 	username        string
+	account         string
 	conn            *websocket.Conn
-	send            chan<- *message
+	send            chan<- *Message
 }
 
 func newWsUser(w http.ResponseWriter, r *http.Request, h *hub) (*wsUser, error) {
+	// Giving a password for a name that isn't registered registers it.
 	user := &struct {
-		Name string
+		Name     string
+		Password string
 	}{}
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		return nil, err
+		return nil, &clientError{http.StatusBadRequest, err.Error()}
 	}
 	defer r.Body.Close()
 
-	if _, ok := h.users[user.Name]; ok {
+	if err := checkName(user.Name); err != nil {
+		return nil, &clientError{http.StatusBadRequest, err.Error()}
+	}
+	if !h.nameAvailable(user.Name) {
 		return nil, errNameNotAvailable
 	}
+	if b := h.bans.nameBanned(user.Name); b != nil {
+		return nil, &clientError{http.StatusForbidden, b.describe()}
+	}
+	if (user.Password != "" || h.accounts.exists(user.Name)) && !h.allowLogin(hostOf(r.RemoteAddr)) {
+		return nil, errTooManyLogins
+	}
+	var account string
+	switch {
+	case h.accounts.exists(user.Name):
+		if err := h.accounts.authenticate(user.Name, user.Password); err != nil {
+			return nil, err
+		}
+		account = user.Name
+	case user.Password != "":
+		if err := h.accounts.register(user.Name, user.Password); err != nil {
+			return nil, err
+		}
+		account = user.Name
+	case h.cfg.RequireLogin:
+		return nil, errLoginRequired
+	}
 
 	wsconn, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if err != nil {
@@ -40,8 +83,8 @@ func newWsUser(w http.ResponseWriter, r *http.Request, h *hub) (*wsUser, error)
 
 	return &wsUser{
 		currentRoomName: defaultChannelName,
-		muted:           make(map[string]bool),
 		username:        user.Name,
+		account:         account,
 		conn:            wsconn,
 		send:            h.messageCh,
 	}, nil
@@ -49,17 +92,48 @@ func newWsUser(w http.ResponseWriter, r *http.Request, h *hub) (*wsUser, error)
 
 func (ws *wsUser) read() error {
 	for {
-		msg := &message{}
+		msg := &Message{}
 		err := ws.conn.ReadJSON(msg)
 		if err != nil {
-			// not sure how to handle this based on severity...
-			continue
+			// A message that isn't valid JSON is the client's problem, but
+			// anything else means the connection is gone.
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				continue
+			}
+			ws.post(newMessage("everyone", ws.name(), ws.name()+" has left that chat\n", quit))
+			return err
 		}
-		ws.send <- msg
+		// Text starting with a slash is a command, just like over TCP.
+		if msg.MessageType == text && strings.HasPrefix(msg.Text, "/") {
+			msg.MessageType = command
+			msg.Text = strings.TrimSpace(msg.Text)
+		}
+		ws.post(msg)
 	}
 }
 
-func (ws *wsUser) write(message *message) error {
+// post sends m to the hub, stamped with the name this connection logged in
+// as. The hub refuses it if the client said it was from someone else.
+func (ws *wsUser) post(m *Message) {
+	m.from = ws.name()
+	ws.send <- m
+}
+
+func (ws *wsUser) name() string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.username
+}
+
+func (ws *wsUser) write(message *Message) error {
+	// Renaming the user changes the name their messages are stamped with.
+	ws.mu.Lock()
+	if message.MessageType == nick && message.Username == ws.username {
+		ws.username = message.Channel
+	}
+	ws.mu.Unlock()
 	return ws.conn.WriteJSON(message)
 }
 